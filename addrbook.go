@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// The address book remembers the addresses of peers the node has connected
+// to and handshaken with, however they were discovered, so a restarted node
+// can dial them again without waiting for discovery. Entries are persisted;
+// once the book is full the peer seen least recently is forgotten.
+
+const maxAddrBookEntries = 1000
+
+// AddrEntry is the address book entry of a peer
+type AddrEntry struct {
+	Addrs    []string // Multiaddrs without the /p2p component
+	LastSeen time.Time
+}
+
+// AddrStore persists the address book, see BoltDB
+type AddrStore interface {
+	SavePeerAddrs(id string, entry AddrEntry) error
+	DeletePeerAddrs(id string) error
+	LoadPeerAddrs() (map[string]AddrEntry, error)
+}
+
+// AddressBook tracks the known addresses of peers. It is safe for concurrent
+// use.
+type AddressBook struct {
+	entries map[peer.ID]AddrEntry
+	store   AddrStore
+	now     func() time.Time
+	mutex   sync.Mutex
+}
+
+// NewAddressBook loads the entries of store, which may be nil to keep the
+// book in memory only
+func NewAddressBook(store AddrStore) (*AddressBook, error) {
+	ab := &AddressBook{
+		entries: make(map[peer.ID]AddrEntry),
+		store:   store,
+		now:     time.Now,
+	}
+	if store == nil {
+		return ab, nil
+	}
+
+	entries, err := store.LoadPeerAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load address book: %w", err)
+	}
+	for id, entry := range entries {
+		ab.entries[peer.ID(id)] = entry
+	}
+	return ab, nil
+}
+
+// Add records the addresses of a peer, marking it as seen now
+func (ab *AddressBook) Add(info peer.AddrInfo) {
+	if len(info.Addrs) == 0 {
+		return
+	}
+	entry := AddrEntry{LastSeen: ab.now()}
+	for _, addr := range ma.Unique(info.Addrs) {
+		entry.Addrs = append(entry.Addrs, addr.String())
+	}
+
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	if _, ok := ab.entries[info.ID]; !ok && len(ab.entries) >= maxAddrBookEntries {
+		ab.evictOldest()
+	}
+	ab.entries[info.ID] = entry
+
+	if ab.store != nil {
+		if err := ab.store.SavePeerAddrs(string(info.ID), entry); err != nil {
+			fmt.Printf("❌ Failed to persist addresses of %s: %v\n", info.ID, err)
+		}
+	}
+}
+
+// Remove forgets a peer
+func (ab *AddressBook) Remove(id peer.ID) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	ab.remove(id)
+}
+
+// Peers returns the known peers, the most recently seen first. Addresses
+// that no longer parse are skipped.
+func (ab *AddressBook) Peers() []peer.AddrInfo {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	ids := make([]peer.ID, 0, len(ab.entries))
+	for id := range ab.entries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ab.entries[ids[i]].LastSeen.After(ab.entries[ids[j]].LastSeen)
+	})
+
+	peers := make([]peer.AddrInfo, 0, len(ids))
+	for _, id := range ids {
+		info := peer.AddrInfo{ID: id}
+		for _, s := range ab.entries[id].Addrs {
+			if addr, err := ma.NewMultiaddr(s); err == nil {
+				info.Addrs = append(info.Addrs, addr)
+			}
+		}
+		if len(info.Addrs) > 0 {
+			peers = append(peers, info)
+		}
+	}
+	return peers
+}
+
+// Len returns the number of known peers
+func (ab *AddressBook) Len() int {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	return len(ab.entries)
+}
+
+// evictOldest forgets the peer seen least recently. The caller must hold the
+// mutex.
+func (ab *AddressBook) evictOldest() {
+	var oldest peer.ID
+	var oldestSeen time.Time
+	for id, entry := range ab.entries {
+		if oldest == "" || entry.LastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = id, entry.LastSeen
+		}
+	}
+	if oldest != "" {
+		ab.remove(oldest)
+	}
+}
+
+// remove forgets a peer. The caller must hold the mutex.
+func (ab *AddressBook) remove(id peer.ID) {
+	if _, ok := ab.entries[id]; !ok {
+		return
+	}
+	delete(ab.entries, id)
+	if ab.store != nil {
+		if err := ab.store.DeletePeerAddrs(string(id)); err != nil {
+			fmt.Printf("❌ Failed to forget addresses of %s: %v\n", id, err)
+		}
+	}
+}
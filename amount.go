@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Amount is a quantity of coins in base units. One coin is
+// BaseUnitsPerCoin base units.
+type Amount int64
+
+const (
+	// AmountDecimals is the number of decimal places a coin divides into
+	AmountDecimals = 8
+	// BaseUnitsPerCoin is the number of base units in one coin
+	BaseUnitsPerCoin Amount = 100_000_000
+	// MaxMoney is the maximum supply. No amount, sum of amounts or total
+	// of coins ever minted may exceed it.
+	MaxMoney Amount = 21_000_000 * BaseUnitsPerCoin
+)
+
+// Amount errors
+var (
+	ErrAmountOutOfRange = errors.New("amount out of range")
+	ErrInvalidAmount    = errors.New("invalid amount")
+)
+
+// Coins converts a whole number of coins to an Amount
+func Coins(n int64) Amount {
+	return Amount(n) * BaseUnitsPerCoin
+}
+
+// IsValid reports whether the amount is between zero and MaxMoney
+func (a Amount) IsValid() bool {
+	return a >= 0 && a <= MaxMoney
+}
+
+// Add returns a + b, failing if either operand or the result is outside
+// [0, MaxMoney]
+func (a Amount) Add(b Amount) (Amount, error) {
+	if !a.IsValid() || !b.IsValid() {
+		return 0, fmt.Errorf("%w: %d + %d", ErrAmountOutOfRange, a, b)
+	}
+	// Both operands are at most MaxMoney, so the sum cannot overflow int64
+	sum := a + b
+	if !sum.IsValid() {
+		return 0, fmt.Errorf("%w: %s + %s exceeds the maximum supply", ErrAmountOutOfRange, a, b)
+	}
+	return sum, nil
+}
+
+// Sub returns a - b, failing if either operand or the result is outside
+// [0, MaxMoney]
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if !a.IsValid() || !b.IsValid() || b > a {
+		return 0, fmt.Errorf("%w: %d - %d", ErrAmountOutOfRange, a, b)
+	}
+	return a - b, nil
+}
+
+// SumAmounts adds up amounts with overflow checking
+func SumAmounts(amounts ...Amount) (Amount, error) {
+	var total Amount
+	for _, a := range amounts {
+		var err error
+		if total, err = total.Add(a); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// String formats the amount in coins, e.g. "12.5"
+func (a Amount) String() string {
+	sign := ""
+	u := uint64(a)
+	if a < 0 {
+		sign = "-"
+		u = uint64(-(a + 1)) + 1 // Safe for math.MinInt64
+	}
+
+	whole := u / uint64(BaseUnitsPerCoin)
+	frac := u % uint64(BaseUnitsPerCoin)
+	if frac == 0 {
+		return fmt.Sprintf("%s%d", sign, whole)
+	}
+	fracStr := strings.TrimRight(fmt.Sprintf("%0*d", AmountDecimals, frac), "0")
+	return fmt.Sprintf("%s%d.%s", sign, whole, fracStr)
+}
+
+// ParseAmount parses a decimal coin amount such as "12.5" with at most
+// AmountDecimals decimal places. Amounts beyond MaxMoney either way are out
+// of range.
+func ParseAmount(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	whole, frac, _ := strings.Cut(strings.TrimPrefix(s, "-"), ".")
+	if whole == "" && frac == "" || len(frac) > AmountDecimals || strings.ContainsAny(whole+frac, "+-") {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+
+	var coins, units uint64
+	var err error
+	if whole != "" {
+		if coins, err = strconv.ParseUint(whole, 10, 64); err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+	}
+	if frac != "" {
+		if units, err = strconv.ParseUint(frac+strings.Repeat("0", AmountDecimals-len(frac)), 10, 64); err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+	}
+
+	// Checked in two steps so the multiplication cannot overflow
+	if coins > uint64(MaxMoney/BaseUnitsPerCoin) {
+		return 0, fmt.Errorf("%w: %q", ErrAmountOutOfRange, s)
+	}
+	amount := Amount(coins)*BaseUnitsPerCoin + Amount(units)
+	if amount > MaxMoney {
+		return 0, fmt.Errorf("%w: %q", ErrAmountOutOfRange, s)
+	}
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// MarshalJSON encodes the amount as a decimal string of coins
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(a.String())), nil
+}
+
+// UnmarshalJSON accepts a decimal string of coins, or a plain JSON number
+// for convenience
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	amount, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+// Scan implements fmt.Scanner, reading a decimal amount of coins
+func (a *Amount) Scan(state fmt.ScanState, verb rune) error {
+	token, err := state.Token(true, nil)
+	if err != nil {
+		return err
+	}
+
+	amount, err := ParseAmount(string(token))
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+// FeeRate is a fee per 1000 bytes of encoded transaction, in base units
+type FeeRate int64
+
+// NewFeeRate returns the rate at which fee pays for size bytes
+func NewFeeRate(fee Amount, size int) FeeRate {
+	if size <= 0 {
+		return 0
+	}
+	return FeeRate(int64(fee) * 1000 / int64(size))
+}
+
+// Fee returns the fee for size bytes at the rate, rounded up. A fee beyond
+// MaxMoney, which no transaction can pay, is returned as MaxMoney.
+func (r FeeRate) Fee(size int) Amount {
+	if r > 0 && size > 0 && int64(r) > int64(MaxMoney)*1000/int64(size) {
+		return MaxMoney
+	}
+	return Amount((int64(r)*int64(size) + 999) / 1000)
+}
+
+// String formats the rate in coins per 1000 bytes, e.g. "0.0001/kB"
+func (r FeeRate) String() string {
+	return Amount(r).String() + "/kB"
+}
+
+// ParseFeeRate parses a decimal amount of coins per 1000 bytes, optionally
+// followed by "/kB"
+func ParseFeeRate(s string) (FeeRate, error) {
+	amount, err := ParseAmount(strings.TrimSuffix(strings.TrimSpace(s), "/kB"))
+	if err != nil {
+		return 0, err
+	}
+	if amount < 0 {
+		return 0, fmt.Errorf("%w: fee rate %q is negative", ErrInvalidAmount, s)
+	}
+	return FeeRate(amount), nil
+}
+
+// MarshalJSON encodes the rate as a decimal string of coins per 1000 bytes
+func (r FeeRate) MarshalJSON() ([]byte, error) {
+	return Amount(r).MarshalJSON()
+}
+
+// UnmarshalJSON accepts what Amount.UnmarshalJSON accepts
+func (r *FeeRate) UnmarshalJSON(data []byte) error {
+	return (*Amount)(r).UnmarshalJSON(data)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestAmountParseAndFormat(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+		out  string
+	}{
+		{"12.5", Coins(12) + BaseUnitsPerCoin/2, "12.5"},
+		{"0.00000001", 1, "0.00000001"},
+		{"21000000", MaxMoney, "21000000"},
+		{".5", BaseUnitsPerCoin / 2, "0.5"},
+		{"7", Coins(7), "7"},
+	}
+	for _, tt := range tests {
+		got, err := ParseAmount(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseAmount(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+			continue
+		}
+		if got.String() != tt.out {
+			t.Errorf("Amount(%d).String() = %q, want %q", got, got.String(), tt.out)
+		}
+	}
+
+	for _, in := range []string{"", ".", "1.000000001", "1e3", "abc", "1.-5", "99999999999999999999"} {
+		if _, err := ParseAmount(in); err == nil {
+			t.Errorf("ParseAmount(%q) accepted an invalid amount", in)
+		}
+	}
+
+	// Beyond the maximum supply, including values whose base units would
+	// overflow an int64
+	for _, in := range []string{"21000000.00000001", "-21000000.00000001", "92233720368.99999999", "-92233720368.99999999"} {
+		if got, err := ParseAmount(in); !errors.Is(err, ErrAmountOutOfRange) {
+			t.Errorf("ParseAmount(%q) = %d, %v, want %v", in, got, err, ErrAmountOutOfRange)
+		}
+	}
+}
+
+func TestAmountArithmetic(t *testing.T) {
+	if sum, err := SumAmounts(Coins(1), BaseUnitsPerCoin/10, BaseUnitsPerCoin/5); err != nil || sum.String() != "1.3" {
+		t.Errorf("SumAmounts() = %s, %v, want 1.3", sum, err)
+	}
+	if _, err := MaxMoney.Add(1); !errors.Is(err, ErrAmountOutOfRange) {
+		t.Errorf("Add() beyond the maximum supply error = %v, want %v", err, ErrAmountOutOfRange)
+	}
+	if _, err := Amount(1 << 62).Add(1 << 62); !errors.Is(err, ErrAmountOutOfRange) {
+		t.Errorf("Add() of overflowing amounts error = %v, want %v", err, ErrAmountOutOfRange)
+	}
+	if _, err := Coins(1).Sub(Coins(2)); !errors.Is(err, ErrAmountOutOfRange) {
+		t.Errorf("Sub() below zero error = %v, want %v", err, ErrAmountOutOfRange)
+	}
+
+	// Fees round up, and a rate too high to pay stops at the maximum supply
+	if fee := FeeRate(1000).Fee(250); fee != 250 {
+		t.Errorf("Fee() = %d, want 250", fee)
+	}
+	if fee := FeeRate(1).Fee(250); fee != 1 {
+		t.Errorf("Fee() of a fraction of a base unit = %d, want 1", fee)
+	}
+	if fee := FeeRate(MaxMoney).Fee(MaxBlockSize); fee != MaxMoney {
+		t.Errorf("Fee() at the maximum rate = %d, want %d", fee, MaxMoney)
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	data, err := json.Marshal(TransactionRequest{Receiver: "r", Amount: Coins(3) / 2, Fee: 1})
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	if want := `{"Receiver":"r","Amount":"1.5","Fee":"0.00000001"}`; string(data) != want {
+		t.Errorf("json.Marshal() = %s, want %s", data, want)
+	}
+
+	var req TransactionRequest
+	if err := json.Unmarshal([]byte(`{"Amount":"2.25","Fee":0.1}`), &req); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if req.Amount.String() != "2.25" || req.Fee.String() != "0.1" {
+		t.Errorf("json.Unmarshal() = %s, %s", req.Amount, req.Fee)
+	}
+}
+
+func TestBlockSubsidyStopsAtMaxMoney(t *testing.T) {
+	params := DevNetParams
+	params.GenesisAllocations = []GenesisAllocation{{Address: newTestAddress(t), Amount: MaxMoney - Coins(120)}}
+	if err := params.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	want := []Amount{0, Coins(50), Coins(50), Coins(20), 0}
+	for height, subsidy := range want {
+		if got := params.BlockSubsidyAt(height); got != subsidy {
+			t.Errorf("BlockSubsidyAt(%d) = %s, want %s", height, got, subsidy)
+		}
+	}
+
+	params.GenesisAllocations = append(params.GenesisAllocations, params.GenesisAllocations[0])
+	if err := params.Validate(); err == nil {
+		t.Error("Validate() accepted genesis allocations above the maximum supply")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Every peer starts with a score of initialPeerScore. Misbehavior subtracts a
+// penalty, which wears off with a half-life of peerScoreHalfLife; a peer
+// whose score drops to zero is disconnected and banned for the ban duration.
+// Bans are persisted, and the BanManager doubles as the libp2p
+// ConnectionGater that refuses banned peers.
+
+const (
+	initialPeerScore   = 100
+	peerScoreHalfLife  = time.Hour
+	DefaultBanDuration = 24 * time.Hour
+)
+
+// Misbehavior penalties
+const (
+	PenaltyInvalidBlock     = 100 // Block or headers that fail validation
+	PenaltyBadSignature     = 50  // Relayed transaction with a bad signature
+	PenaltyOversizedMessage = 50  // Frame above the limit of its type
+	PenaltyMalformedMessage = 20  // Frame or payload that does not decode
+	PenaltyUnsolicited      = 10  // Message or reply we did not ask for
+)
+
+// BanStore persists bans, see BoltDB
+type BanStore interface {
+	SaveBan(id string, until time.Time) error
+	DeleteBan(id string) error
+	LoadBans() (map[string]time.Time, error)
+}
+
+// peerPenalty is the penalty a peer had at the time of its last misbehavior
+type peerPenalty struct {
+	points  int
+	updated time.Time
+}
+
+// at returns what is left of the penalty at now, rounded
+func (p peerPenalty) at(now time.Time) int {
+	halfLives := float64(now.Sub(p.updated)) / float64(peerScoreHalfLife)
+	return int(math.Round(float64(p.points) * math.Exp2(-halfLives)))
+}
+
+// BanManager tracks peer scores and bans. It is safe for concurrent use.
+type BanManager struct {
+	scores   map[peer.ID]peerPenalty
+	bans     map[peer.ID]time.Time // Peer -> end of its ban
+	store    BanStore
+	duration time.Duration
+	now      func() time.Time
+	mutex    sync.Mutex
+}
+
+// NewBanManager loads the unexpired bans of store, which may be nil to keep
+// bans in memory only
+func NewBanManager(store BanStore, duration time.Duration) (*BanManager, error) {
+	bm := &BanManager{
+		scores:   make(map[peer.ID]peerPenalty),
+		bans:     make(map[peer.ID]time.Time),
+		store:    store,
+		duration: duration,
+		now:      time.Now,
+	}
+	if store == nil {
+		return bm, nil
+	}
+
+	bans, err := store.LoadBans()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bans: %w", err)
+	}
+	for id, until := range bans {
+		if until.After(bm.now()) {
+			bm.bans[peer.ID(id)] = until
+		} else if err := store.DeleteBan(id); err != nil {
+			return nil, fmt.Errorf("failed to lift expired ban: %w", err)
+		}
+	}
+	return bm, nil
+}
+
+// Score returns the current score of a peer
+func (bm *BanManager) Score(id peer.ID) int {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	points := bm.scores[id].at(bm.now())
+	if points == 0 {
+		delete(bm.scores, id)
+	}
+	return initialPeerScore - points
+}
+
+// Penalize lowers the score of a peer and bans it once the score reaches
+// zero. It reports whether the peer is now banned.
+func (bm *BanManager) Penalize(id peer.ID, penalty int, reason string) bool {
+	bm.mutex.Lock()
+	now := bm.now()
+	bm.forgetDecayed(now)
+	points := bm.scores[id].at(now) + penalty
+	bm.scores[id] = peerPenalty{points: points, updated: now}
+	score := initialPeerScore - points
+	bm.mutex.Unlock()
+
+	fmt.Printf("⚠️ Peer %s misbehaved (%s), score %d\n", id, reason, score)
+	if score > 0 {
+		return false
+	}
+	bm.Ban(id)
+	return true
+}
+
+// forgetDecayed drops the penalties that have worn off by now, so peers that
+// misbehaved once do not stay in scores forever. The caller holds the mutex.
+func (bm *BanManager) forgetDecayed(now time.Time) {
+	for id, p := range bm.scores {
+		if p.at(now) == 0 {
+			delete(bm.scores, id)
+		}
+	}
+}
+
+// Ban bans a peer for the ban duration
+func (bm *BanManager) Ban(id peer.ID) {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	until := bm.now().Add(bm.duration)
+	bm.bans[id] = until
+	delete(bm.scores, id)
+	fmt.Printf("🚫 Banned peer %s until %s\n", id, until.Format(time.RFC3339))
+
+	if bm.store != nil {
+		if err := bm.store.SaveBan(string(id), until); err != nil {
+			fmt.Printf("❌ Failed to persist ban of %s: %v\n", id, err)
+		}
+	}
+}
+
+// IsBanned reports whether a peer is banned, lifting an expired ban
+func (bm *BanManager) IsBanned(id peer.ID) bool {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	until, ok := bm.bans[id]
+	if !ok {
+		return false
+	}
+	if until.After(bm.now()) {
+		return true
+	}
+
+	delete(bm.bans, id)
+	if bm.store != nil {
+		if err := bm.store.DeleteBan(string(id)); err != nil {
+			fmt.Printf("❌ Failed to lift ban of %s: %v\n", id, err)
+		}
+	}
+	return false
+}
+
+// InterceptPeerDial refuses to dial banned peers
+func (bm *BanManager) InterceptPeerDial(id peer.ID) bool {
+	return !bm.IsBanned(id)
+}
+
+// InterceptAddrDial refuses to dial banned peers
+func (bm *BanManager) InterceptAddrDial(id peer.ID, _ ma.Multiaddr) bool {
+	return !bm.IsBanned(id)
+}
+
+// InterceptAccept allows every inbound connection; the peer is not known
+// until the connection is secured
+func (bm *BanManager) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+// InterceptSecured refuses connections from and to banned peers
+func (bm *BanManager) InterceptSecured(_ network.Direction, id peer.ID, _ network.ConnMultiaddrs) bool {
+	return !bm.IsBanned(id)
+}
+
+// InterceptUpgraded allows every connection that passed InterceptSecured
+func (bm *BanManager) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// penalizePeer penalizes a peer if the node tracks scores, disconnecting it
+// once it is banned
+func penalizePeer(h host.Host, state *BlockchainState, id peer.ID, penalty int, reason string) {
+	bans := state.GetBanManager()
+	if bans == nil || penalty <= 0 {
+		return
+	}
+	if bans.Penalize(id, penalty, reason) && h != nil {
+		h.Network().ClosePeer(id)
+	}
+}
+
+// framePenalty returns the penalty for a failure to read a frame. Timeouts
+// and closed streams are not penalized.
+func framePenalty(err error) int {
+	switch {
+	case errors.Is(err, ErrFrameTooLarge):
+		return PenaltyOversizedMessage
+	case errors.Is(err, ErrUnknownMessageType):
+		return PenaltyMalformedMessage
+	}
+	return 0
+}
@@ -4,44 +4,64 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"strings"
+	"math/big"
 	"time"
 )
 
-// Update the Block struct
+// BlockHeader holds the fields covered by the block hash. It commits to the
+// transactions through MerkleRoot, so a chain of headers can be validated
+// before any block body is downloaded.
+type BlockHeader struct {
+	Index      int    `json:"index"`
+	Timestamp  int64  `json:"timestamp"` // Unix seconds
+	PrevHash   string `json:"prevHash"`
+	MerkleRoot []byte `json:"merkleRoot"`
+	Bits       uint32 `json:"bits"` // Compact proof-of-work target
+	Nonce      int    `json:"nonce"`
+}
+
+// BlockHash hashes the canonical encoding of the header
+func (h BlockHeader) BlockHash() string {
+	hash := sha256.Sum256(EncodeBlockHeader(h))
+	return hex.EncodeToString(hash[:])
+}
+
+// Block is a header together with its body. The header fields are embedded,
+// so block.Index and friends read the header.
 type Block struct {
-	Index        int           `json:"index"`
-	Timestamp    string        `json:"timestamp"`
-	Transactions []Transaction `json:"transactions"`
-	PrevHash     string        `json:"prevHash"`
+	BlockHeader
 	Hash         string        `json:"hash"`
-	Nonce        int           `json:"nonce"`
-	MerkleRoot   []byte        `json:"merkleRoot"`
-	Difficulty   int           `json:"difficulty"`
+	ChainWork    string        `json:"chainWork"` // Hex total work up to and including this block
+	Transactions []Transaction `json:"transactions"`
 }
 
-// Generate hash for a block
+// CalculateBlockHash hashes the header of a block
 func CalculateBlockHash(block Block) string {
-	record := fmt.Sprintf("%d%s%s%d%s%d",
-		block.Index,
-		block.Timestamp,
-		block.PrevHash,
-		block.Nonce,
-		hex.EncodeToString(block.MerkleRoot),
-		block.Difficulty,
-	)
-	hash := sha256.Sum256([]byte(record))
-	return hex.EncodeToString(hash[:])
+	return block.BlockHeader.BlockHash()
 }
 
-func GenerateBlock(prevBlock Block, transactions []Transaction) Block {
+// withCoinbase prepends a coinbase paying the subsidy plus the fees of
+// transactions to minerAddress
+func withCoinbase(transactions []Transaction, height int, minerAddress string) []Transaction {
+	reward, _ := CalculateBlockReward(Block{BlockHeader: BlockHeader{Index: height}, Transactions: transactions})
+	coinbase := NewCoinbaseTransaction(minerAddress, height, reward)
+	return append([]Transaction{coinbase}, transactions...)
+}
+
+// GenerateBlock mines a block on top of prevBlock. bits is the target the
+// chain expects next, see CalcNextBits.
+func GenerateBlock(prevBlock Block, transactions []Transaction, minerAddress string, bits uint32) Block {
+	transactions = withCoinbase(transactions, prevBlock.Index+1, minerAddress)
 	newBlock := Block{
-		Index:        prevBlock.Index + 1,
-		Timestamp:    time.Now().String(),
+		BlockHeader: BlockHeader{
+			Index:     prevBlock.Index + 1,
+			Timestamp: blockTimestamp(prevBlock),
+			PrevHash:  prevBlock.Hash,
+			Bits:      bits,
+			Nonce:     0,
+		},
 		Transactions: transactions,
-		PrevHash:     prevBlock.Hash,
-		Difficulty:   1, // Reduced difficulty for testing
-		Nonce:        0,
+		ChainWork:    CalcChainWork(prevBlock, bits),
 	}
 
 	merkleRoot, err := GetMerkleRoot(transactions)
@@ -50,7 +70,7 @@ func GenerateBlock(prevBlock Block, transactions []Transaction) Block {
 	}
 
 	// Mine with faster timeout for tests
-	target := strings.Repeat("0", newBlock.Difficulty)
+	target := CompactToBig(newBlock.Bits)
 	timeout := time.After(2 * time.Second)
 
 	for {
@@ -60,7 +80,7 @@ func GenerateBlock(prevBlock Block, transactions []Transaction) Block {
 			return newBlock
 		default:
 			newBlock.Hash = CalculateBlockHash(newBlock)
-			if strings.HasPrefix(newBlock.Hash, target) {
+			if meetsTarget(newBlock.Hash, target) {
 				return newBlock
 			}
 			newBlock.Nonce++
@@ -68,27 +88,67 @@ func GenerateBlock(prevBlock Block, transactions []Transaction) Block {
 	}
 }
 
+// blockTimestamp returns the current time, but never earlier than the
+// parent, so blocks mined in quick succession stay in order
+func blockTimestamp(prevBlock Block) int64 {
+	if now := time.Now().Unix(); now > prevBlock.Timestamp {
+		return now
+	}
+	return prevBlock.Timestamp
+}
+
 // Genesis Block (first block)
 func CreateGenesisBlock() Block {
+	genesis := buildGenesisBlock(activeParams)
+
+	fmt.Printf("🌟 Creating Genesis Block:\n  Network: %s\n  Index: %d\n  Hash: %s\n",
+		activeParams.Name, genesis.Index, genesis.Hash)
+
+	return genesis
+}
+
+// buildGenesisBlock derives the genesis block from the network params only,
+// so every node on the same network gets the same hash
+func buildGenesisBlock(params *NetworkParams) Block {
+	timestamp := time.Unix(params.GenesisTimestamp, 0).UTC()
+
+	// All allocations are outputs of a single input-less transaction
+	transactions := []Transaction{}
+	if len(params.GenesisAllocations) > 0 {
+		tx := Transaction{Timestamp: timestamp}
+		for _, alloc := range params.GenesisAllocations {
+			tx.Outputs = append(tx.Outputs, TxOutput{Address: alloc.Address, Amount: alloc.Amount})
+		}
+		tx.TxID = CalculateTxID(tx)
+		transactions = append(transactions, tx)
+	}
+
 	genesis := Block{
-		Index:        0, // Ensure index is 0
-		Timestamp:    time.Now().String(),
-		Transactions: []Transaction{},
-		PrevHash:     "", // Empty for genesis
-		Difficulty:   1,
-		Nonce:        0,
+		BlockHeader: BlockHeader{
+			Index:     0, // Ensure index is 0
+			Timestamp: timestamp.Unix(),
+			PrevHash:  "", // Empty for genesis
+			Bits:      params.GenesisBits,
+			Nonce:     params.GenesisNonce,
+		},
+		Transactions: transactions,
+		ChainWork:    CalcWork(params.GenesisBits).Text(16),
+	}
+
+	if merkleRoot, err := GetMerkleRoot(transactions); err == nil {
+		genesis.MerkleRoot = merkleRoot
 	}
 
 	// Calculate hash for genesis block
 	genesis.Hash = CalculateBlockHash(genesis)
-
-	fmt.Printf("🌟 Creating Genesis Block:\n  Index: %d\n  Hash: %s\n",
-		genesis.Index, genesis.Hash)
-
 	return genesis
 }
 
 func ValidateBlockchain(chain []Block) bool {
+	if len(chain) > 0 && chain[0].Hash != activeParams.GenesisHash() {
+		return false
+	}
+
 	for i := 1; i < len(chain); i++ {
 		currentBlock := chain[i]
 		previousBlock := chain[i-1]
@@ -100,46 +160,30 @@ func ValidateBlockchain(chain []Block) bool {
 		if currentBlock.Hash != CalculateBlockHash(currentBlock) {
 			return false
 		}
-	}
-	return true
-}
-
-// Add debug logging to ValidateBlock
-func ValidateBlock(block Block, prevBlock Block) error {
-	fmt.Printf("🔍 Validating block:\n  Index: %d\n  PrevHash: %s\n",
-		block.Index, block.PrevHash)
 
-	// Special case for genesis block
-	if block.Index == 0 {
-		fmt.Println("🌟 Validating genesis block...")
-		if block.PrevHash != "" {
-			return fmt.Errorf("genesis block must have empty PrevHash")
+		if currentBlock.Bits != CalcNextBits(chain[:i]) {
+			return false
 		}
-		return nil
-	}
 
-	// Validate block index
-	if block.Index != prevBlock.Index+1 {
-		return fmt.Errorf("invalid block index: got %d, want %d",
-			block.Index, prevBlock.Index+1)
-	}
-
-	// Validate previous hash
-	if block.PrevHash != prevBlock.Hash {
-		return fmt.Errorf("invalid previous hash")
+		if currentBlock.ChainWork != CalcChainWork(previousBlock, currentBlock.Bits) {
+			return false
+		}
 	}
-
-	return nil
+	return true
 }
 
-func NewBlock(transactions []Transaction, prevBlock Block) (*Block, error) {
+func NewBlock(transactions []Transaction, prevBlock Block, minerAddress string, bits uint32) (*Block, error) {
+	transactions = withCoinbase(transactions, prevBlock.Index+1, minerAddress)
 	block := &Block{
-		Index:        prevBlock.Index + 1,
-		Timestamp:    time.Now().String(),
+		BlockHeader: BlockHeader{
+			Index:     prevBlock.Index + 1,
+			Timestamp: blockTimestamp(prevBlock),
+			PrevHash:  prevBlock.Hash,
+			Bits:      bits,
+			Nonce:     0,
+		},
 		Transactions: transactions,
-		PrevHash:     prevBlock.Hash,
-		Difficulty:   4, // Default difficulty
-		Nonce:        0,
+		ChainWork:    CalcChainWork(prevBlock, bits),
 	}
 
 	// Calculate Merkle root
@@ -156,12 +200,12 @@ func NewBlock(transactions []Transaction, prevBlock Block) (*Block, error) {
 }
 
 func MineBlock(block *Block) string {
-	target := strings.Repeat("0", block.Difficulty)
+	target := CompactToBig(block.Bits)
 	maxAttempts := 100000 // Limit attempts for tests
 
 	for i := 0; i < maxAttempts; i++ {
 		hash := CalculateBlockHash(*block)
-		if strings.HasPrefix(hash, target) {
+		if meetsTarget(hash, target) {
 			return hash
 		}
 		block.Nonce++
@@ -170,3 +214,9 @@ func MineBlock(block *Block) string {
 	// Return current hash if mining takes too long
 	return CalculateBlockHash(*block)
 }
+
+// meetsTarget reports whether a hex hash is at or below target
+func meetsTarget(hash string, target *big.Int) bool {
+	hashNum, err := HashToBig(hash)
+	return err == nil && hashNum.Cmp(target) <= 0
+}
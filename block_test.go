@@ -2,6 +2,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -11,8 +17,8 @@ import (
 
 func TestMerkleTreeVerification(t *testing.T) {
 	transactions := []Transaction{
-		{SenderAddress: "Alice", Receiver: "Bob", Amount: 10},
-		{SenderAddress: "Bob", Receiver: "Charlie", Amount: 5},
+		{SenderAddress: "Alice", Outputs: []TxOutput{{Address: "Bob", Amount: 10}}},
+		{SenderAddress: "Bob", Outputs: []TxOutput{{Address: "Charlie", Amount: 5}}},
 	}
 
 	// Calculate TxIDs
@@ -20,13 +26,18 @@ func TestMerkleTreeVerification(t *testing.T) {
 		transactions[i].TxID = CalculateTxID(transactions[i])
 	}
 
-	merkleTree, err := NewMerkleTree(transactions)
+	block := GenerateBlock(Block{}, transactions, newTestAddress(t), ActiveNetwork().GenesisBits)
+
+	// The block commits to its coinbase followed by the given transactions
+	if len(block.Transactions) != len(transactions)+1 || !block.Transactions[0].IsCoinbase() {
+		t.Fatalf("Expected coinbase plus %d transactions, got %d", len(transactions), len(block.Transactions))
+	}
+
+	merkleTree, err := NewMerkleTree(block.Transactions)
 	if err != nil {
 		t.Fatalf("Failed to create Merkle tree: %v", err)
 	}
 
-	block := GenerateBlock(Block{}, transactions)
-
 	if !bytes.Equal(block.MerkleRoot, merkleTree.MerkleRoot()) {
 		t.Error("Merkle root mismatch")
 	}
@@ -34,9 +45,9 @@ func TestMerkleTreeVerification(t *testing.T) {
 
 func TestBlockGeneration(t *testing.T) {
 	genesis := CreateGenesisBlock()
-	tx := Transaction{SenderAddress: "Alice", Receiver: "Bob", Amount: 5.0}
+	tx := Transaction{SenderAddress: "Alice", Outputs: []TxOutput{{Address: "Bob", Amount: Coins(5)}}}
 	tx.TxID = CalculateTxID(tx)
-	block := GenerateBlock(genesis, []Transaction{tx})
+	block := GenerateBlock(genesis, []Transaction{tx}, newTestAddress(t), CalcNextBits([]Block{genesis}))
 
 	if block.Index != genesis.Index+1 {
 		t.Errorf("Expected block index %d, got %d", genesis.Index+1, block.Index)
@@ -51,26 +62,25 @@ func TestBlockGeneration(t *testing.T) {
 
 func TestBlockMining(t *testing.T) {
 	tests := []struct {
-		name       string
-		difficulty int
-		wantPrefix string
+		name string
+		bits uint32
 	}{
-		{"Difficulty 1", 1, "0"},
-		{"Difficulty 2", 2, "00"},
-		{"Difficulty 3", 3, "000"},
+		{"Pow limit", DevNetParams.PowLimitBits},
+		{"Devnet genesis", DevNetParams.GenesisBits},
+		{"Harder", 0x1f7fffff},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			block := &Block{
-				Index:      1,
-				Timestamp:  "test",
-				Difficulty: tt.difficulty,
-			}
+			block := &Block{BlockHeader: BlockHeader{
+				Index:     1,
+				Timestamp: 1234567890,
+				Bits:      tt.bits,
+			}}
 
 			hash := MineBlock(block)
-			if !strings.HasPrefix(hash, tt.wantPrefix) {
-				t.Errorf("MineBlock() = %v, want prefix %v", hash, tt.wantPrefix)
+			if err := CheckProofOfWork(hash, tt.bits); err != nil {
+				t.Errorf("MineBlock() = %v: %v", hash, err)
 			}
 		})
 	}
@@ -80,14 +90,13 @@ func TestBlockValidation(t *testing.T) {
 	// Create test transactions
 	tx := Transaction{
 		SenderAddress: "Alice",
-		Receiver:      "Bob",
-		Amount:        10.0,
+		Outputs:       []TxOutput{{Address: "Bob", Amount: Coins(10)}},
 	}
 	transactions := []Transaction{tx}
 
 	// Create and mine a block
-	prevBlock := Block{Index: 0, Hash: "genesis"}
-	block, err := NewBlock(transactions, prevBlock)
+	prevBlock := Block{BlockHeader: BlockHeader{Index: 0}, Hash: "genesis"}
+	block, err := NewBlock(transactions, prevBlock, newTestAddress(t), ActiveNetwork().GenesisBits)
 	if err != nil {
 		t.Fatalf("NewBlock() error = %v", err)
 	}
@@ -112,31 +121,37 @@ func TestConsensusValidation(t *testing.T) {
 	go func() {
 		defer func() { done <- true }()
 
+		// Create wallets, funding the sender in the genesis block
+		wallet, err := NewWallet()
+		if err != nil {
+			t.Errorf("Failed to create wallet: %v", err)
+			return
+		}
+		receiver, err := NewWallet()
+		if err != nil {
+			t.Errorf("Failed to create wallet: %v", err)
+			return
+		}
+		useFundedNetwork(t, wallet, Coins(100))
+
 		state := NewBlockchainState()
 		consensus := NewConsensus(state)
 
 		// Create genesis block
 		genesis := CreateGenesisBlock()
-		genesis.Difficulty = 1
 		if err := state.AddBlock(genesis); err != nil {
 			t.Errorf("Failed to add genesis block: %v", err)
 			return
 		}
 
-		// Create wallet and transaction
-		wallet, err := NewWallet()
+		// Spend the genesis allocation
+		utxos := state.GetSpendableUTXOs(wallet.GetAddress())
+		tx, err := wallet.CreateTransaction(utxos, receiver.GetAddress(), Coins(10), BaseUnitsPerCoin/2)
 		if err != nil {
-			t.Errorf("Failed to create wallet: %v", err)
+			t.Errorf("Failed to create transaction: %v", err)
 			return
 		}
-
-		// Create transaction with fixed timestamp
-		tx := Transaction{
-			SenderAddress: wallet.GetAddress(),
-			Receiver:      "Bob",
-			Amount:        10.0,
-			Timestamp:     time.Unix(1234567890, 0), // Use fixed timestamp
-		}
+		tx.Timestamp = time.Unix(1234567890, 0) // Use fixed timestamp
 
 		// Sign transaction
 		if err := wallet.SignTransaction(&tx); err != nil {
@@ -144,14 +159,20 @@ func TestConsensusValidation(t *testing.T) {
 			return
 		}
 
-		// Create and mine block
+		// Create and mine block, paying the reward to the receiver
+		reward, _ := CalculateBlockReward(Block{BlockHeader: BlockHeader{Index: genesis.Index + 1}, Transactions: []Transaction{tx}})
+		coinbase := NewCoinbaseTransaction(receiver.GetAddress(), genesis.Index+1, reward)
 		block := Block{
-			Index:        genesis.Index + 1,
-			Timestamp:    time.Now().String(),
-			Transactions: []Transaction{tx},
-			PrevHash:     genesis.Hash,
-			Difficulty:   1,
+			BlockHeader: BlockHeader{
+				Index:     genesis.Index + 1,
+				Timestamp: time.Now().Unix(),
+				PrevHash:  genesis.Hash,
+				Bits:      CalcNextBits([]Block{genesis}),
+			},
+			Transactions: []Transaction{coinbase, tx},
 		}
+		block.ChainWork = CalcChainWork(genesis, block.Bits)
+		block.MerkleRoot, _ = GetMerkleRoot(block.Transactions)
 
 		block.Hash = MineBlock(&block)
 		t.Log("Block mined successfully")
@@ -216,8 +237,7 @@ func TestWalletAndTransactionConsistency(t *testing.T) {
 
 	// Create transaction with fixed timestamp for consistent hashing
 	tx := Transaction{
-		Receiver:  "recipient123",
-		Amount:    10.0,
+		Outputs:   []TxOutput{{Address: "recipient123", Amount: Coins(10)}},
 		Timestamp: time.Unix(1234567890, 0), // Use fixed timestamp
 	}
 
@@ -244,3 +264,761 @@ func TestWalletAndTransactionConsistency(t *testing.T) {
 		t.Logf("Derived address: %s", GenerateAddress(tx.SenderPublicKey))
 	}
 }
+
+func TestGenesisIsDeterministic(t *testing.T) {
+	first := CreateGenesisBlock()
+	time.Sleep(10 * time.Millisecond)
+	second := CreateGenesisBlock()
+
+	if first.Hash != second.Hash {
+		t.Errorf("Genesis hash changed between calls: %s != %s", first.Hash, second.Hash)
+	}
+	if first.Hash != ActiveNetwork().GenesisHash() {
+		t.Errorf("Genesis hash %s does not match network params", first.Hash)
+	}
+	if buildGenesisBlock(&TestNetParams).Hash == buildGenesisBlock(&DevNetParams).Hash {
+		t.Error("Different networks derived the same genesis hash")
+	}
+}
+
+func TestLoadNetworkParams(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+
+	params := DevNetParams
+	params.Name = "localnet"
+	params.ChainID = "layla-local-1"
+	params.GenesisAllocations = []GenesisAllocation{{Address: wallet.GetAddress(), Amount: Coins(1000)}}
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		t.Fatalf("Failed to encode params: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "params.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Failed to write params: %v", err)
+	}
+
+	loaded, err := LoadNetworkParams(path)
+	if err != nil {
+		t.Fatalf("LoadNetworkParams() error = %v", err)
+	}
+	if loaded.GenesisHash() != params.GenesisHash() {
+		t.Error("Loaded params derive a different genesis hash")
+	}
+
+	genesis := buildGenesisBlock(loaded)
+	if len(genesis.Transactions) != 1 || genesis.Transactions[0].Outputs[0].Address != wallet.GetAddress() {
+		t.Errorf("Genesis allocations not applied: %+v", genesis.Transactions)
+	}
+
+	// An address from another network must be rejected
+	params.AddressVersion = MainNetParams.AddressVersion
+	if err := params.Validate(); err == nil {
+		t.Error("Validate() accepted an allocation with the wrong address version")
+	}
+}
+
+// useFundedNetwork switches to a devnet whose genesis block pays amount to
+// the wallet, restoring the default network when the test ends
+func useFundedNetwork(t *testing.T, wallet *Wallet, amount Amount) {
+	params := DevNetParams
+	params.GenesisAllocations = []GenesisAllocation{{Address: wallet.GetAddress(), Amount: amount}}
+	SetActiveNetwork(&params)
+	t.Cleanup(func() { SetActiveNetwork(&DevNetParams) })
+}
+
+func TestDoubleSpendRejected(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	receiver, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	useFundedNetwork(t, wallet, Coins(50))
+
+	state := NewBlockchainState()
+	genesis := CreateGenesisBlock()
+	if err := state.AddBlock(genesis); err != nil {
+		t.Fatalf("Failed to add genesis block: %v", err)
+	}
+
+	pay := func(amount Amount) Transaction {
+		utxos := state.GetUTXOSet().FindByAddress(wallet.GetAddress())
+		tx, err := wallet.CreateTransaction(utxos, receiver.GetAddress(), amount, BaseUnitsPerCoin/1000)
+		if err != nil {
+			t.Fatalf("Failed to create transaction: %v", err)
+		}
+		if err := wallet.SignTransaction(&tx); err != nil {
+			t.Fatalf("Failed to sign transaction: %v", err)
+		}
+		return tx
+	}
+
+	first := pay(Coins(20))
+	second := pay(Coins(30))
+	if err := state.AddTransaction(first); err != nil {
+		t.Fatalf("AddTransaction() error = %v", err)
+	}
+	if err := state.AddTransaction(second); !errors.Is(err, ErrMempoolConflict) {
+		t.Errorf("AddTransaction() of a conflicting spend error = %v, want %v", err, ErrMempoolConflict)
+	}
+
+	overspend := pay(Coins(20))
+	overspend.Outputs[0].Amount = Coins(500)
+	if err := wallet.SignTransaction(&overspend); err != nil {
+		t.Fatalf("Failed to sign transaction: %v", err)
+	}
+	if err := NewMempool(state.GetUTXOSet()).AddTransaction(overspend); err == nil {
+		t.Error("AddTransaction() accepted outputs exceeding inputs")
+	}
+
+	block := GenerateBlock(genesis, []Transaction{first}, wallet.GetAddress(), state.GetNextBits())
+	if err := state.AddBlock(block); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+	if got := state.GetUTXOSet().Balance(receiver.GetAddress()); got != Coins(20) {
+		t.Errorf("Receiver balance = %s, want 20", got)
+	}
+
+	// The genesis output is gone, so spending it again must fail everywhere
+	replay := GenerateBlock(block, []Transaction{second}, wallet.GetAddress(), state.GetNextBits())
+	if err := state.AddBlock(replay); !errors.Is(err, ErrMissingOrSpentOutput) {
+		t.Errorf("AddBlock() of a double spend error = %v, want %v", err, ErrMissingOrSpentOutput)
+	}
+	if NewConsensus(state).ValidateChain([]Block{genesis, block, replay}) {
+		t.Error("ValidateChain() accepted a double spend")
+	}
+}
+
+// remine recomputes the merkle root and proof of work of a modified block
+func remine(block *Block) {
+	block.MerkleRoot, _ = GetMerkleRoot(block.Transactions)
+	block.Nonce = 0
+	block.Hash = MineBlock(block)
+}
+
+// newTestAddress returns a fresh address valid on the active network
+func newTestAddress(t *testing.T) string {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	return wallet.GetAddress()
+}
+
+func TestCoinbaseRewardAndMaturity(t *testing.T) {
+	miner, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	receiver := newTestAddress(t)
+
+	state := NewBlockchainState()
+	genesis := CreateGenesisBlock()
+	if err := state.AddBlock(genesis); err != nil {
+		t.Fatalf("Failed to add genesis block: %v", err)
+	}
+
+	// A coinbase paying more than the subsidy is rejected
+	greedy := GenerateBlock(genesis, nil, miner.GetAddress(), state.GetNextBits())
+	greedy.Transactions[0] = NewCoinbaseTransaction(miner.GetAddress(), 1, ActiveNetwork().BlockSubsidy+1)
+	remine(&greedy)
+	if err := state.AddBlock(greedy); !errors.Is(err, ErrBadCoinbaseReward) {
+		t.Errorf("AddBlock() of an overpaying coinbase error = %v, want %v", err, ErrBadCoinbaseReward)
+	}
+
+	// A block without coinbase is rejected
+	empty := GenerateBlock(genesis, nil, miner.GetAddress(), state.GetNextBits())
+	empty.Transactions = nil
+	if err := state.AddBlock(empty); !errors.Is(err, ErrMissingCoinbase) {
+		t.Errorf("AddBlock() without coinbase error = %v, want %v", err, ErrMissingCoinbase)
+	}
+
+	first := GenerateBlock(genesis, nil, miner.GetAddress(), state.GetNextBits())
+	if err := state.AddBlock(first); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+	if got := state.GetUTXOSet().Balance(miner.GetAddress()); got != ActiveNetwork().BlockSubsidy {
+		t.Errorf("Miner balance = %s, want %s", got, ActiveNetwork().BlockSubsidy)
+	}
+
+	// The reward cannot be spent until it matures
+	utxos := state.GetUTXOSet().FindByAddress(miner.GetAddress())
+	spend, err := miner.CreateTransaction(utxos, receiver, Coins(10), Coins(1))
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	if err := miner.SignTransaction(&spend); err != nil {
+		t.Fatalf("Failed to sign transaction: %v", err)
+	}
+	if len(state.GetSpendableUTXOs(miner.GetAddress())) != 0 {
+		t.Error("Immature coinbase reported as spendable")
+	}
+	if err := state.AddTransaction(spend); !errors.Is(err, ErrImmatureCoinbase) {
+		t.Errorf("AddTransaction() of an immature coinbase error = %v, want %v", err, ErrImmatureCoinbase)
+	}
+
+	tip := first
+	for tip.Index-first.Index < ActiveNetwork().CoinbaseMaturity-1 {
+		next := GenerateBlock(tip, nil, receiver, state.GetNextBits())
+		if err := state.AddBlock(next); err != nil {
+			t.Fatalf("AddBlock() error = %v", err)
+		}
+		tip = next
+	}
+
+	if err := state.AddTransaction(spend); err != nil {
+		t.Fatalf("AddTransaction() of a mature coinbase error = %v", err)
+	}
+	block := GenerateBlock(tip, []Transaction{spend}, miner.GetAddress(), state.GetNextBits())
+	if reward, _ := block.Transactions[0].TotalOutput(); reward != ActiveNetwork().BlockSubsidy+Coins(1) {
+		t.Errorf("Coinbase pays %s, want subsidy plus fee %s", reward, ActiveNetwork().BlockSubsidy+Coins(1))
+	}
+	if err := state.AddBlock(block); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+}
+
+func TestCompactTargetRoundTrip(t *testing.T) {
+	for _, bits := range []uint32{0x1d00ffff, 0x1f00ffff, 0x200fffff, 0x207fffff, 0x1b0404cb} {
+		if got := BigToCompact(CompactToBig(bits)); got != bits {
+			t.Errorf("BigToCompact(CompactToBig(0x%08x)) = 0x%08x", bits, got)
+		}
+	}
+
+	// 0x1d00ffff is Bitcoin's genesis target
+	want, _ := new(big.Int).SetString("00000000ffff0000000000000000000000000000000000000000000000000000", 16)
+	if CompactToBig(0x1d00ffff).Cmp(want) != 0 {
+		t.Errorf("CompactToBig(0x1d00ffff) = %x, want %x", CompactToBig(0x1d00ffff), want)
+	}
+}
+
+func TestDifficultyRetarget(t *testing.T) {
+	params := ActiveNetwork()
+	interval := params.RetargetInterval
+
+	// buildChain fakes a chain whose blocks are spacing seconds apart
+	buildChain := func(bits uint32, spacing int64) []Block {
+		chain := make([]Block, interval)
+		for i := range chain {
+			chain[i] = Block{BlockHeader: BlockHeader{Index: i, Timestamp: 1_000_000 + int64(i)*spacing, Bits: bits}}
+		}
+		return chain
+	}
+
+	startBits := uint32(0x1f0fffff)
+	start := CompactToBig(startBits)
+
+	// Between retargets the difficulty is unchanged
+	if got := CalcNextBits(buildChain(startBits, 1)[:interval-1]); got != startBits {
+		t.Errorf("CalcNextBits() off-boundary = 0x%08x, want 0x%08x", got, startBits)
+	}
+
+	// Blocks on schedule keep the target
+	onTime := CompactToBig(CalcNextBits(buildChain(startBits, params.TargetBlockTime)))
+	if onTime.Cmp(start) > 0 {
+		t.Errorf("On-schedule retarget eased the target: %x > %x", onTime, start)
+	}
+
+	// Fast blocks make mining harder, by at most a factor of four
+	fast := CompactToBig(CalcNextBits(buildChain(startBits, 0)))
+	if fast.Cmp(start) >= 0 {
+		t.Errorf("Fast blocks did not lower the target: %x >= %x", fast, start)
+	}
+	quarter := new(big.Int).Div(start, big.NewInt(4))
+	if minTarget := CompactToBig(BigToCompact(quarter)); fast.Cmp(minTarget) < 0 {
+		t.Errorf("Retarget dropped the target below a quarter: %x < %x", fast, minTarget)
+	}
+
+	// Slow blocks make mining easier, capped at the proof-of-work limit
+	slow := CompactToBig(CalcNextBits(buildChain(startBits, params.TargetBlockTime*10)))
+	if slow.Cmp(start) <= 0 {
+		t.Errorf("Slow blocks did not raise the target: %x <= %x", slow, start)
+	}
+	capped := CompactToBig(CalcNextBits(buildChain(params.PowLimitBits, params.TargetBlockTime*10)))
+	if capped.Cmp(CompactToBig(params.PowLimitBits)) > 0 {
+		t.Errorf("Retarget exceeded the proof-of-work limit: %x", capped)
+	}
+
+	// Blocks that ignore the schedule are rejected
+	chain := buildChain(startBits, 0)
+	block := Block{BlockHeader: BlockHeader{Index: interval, PrevHash: chain[interval-1].Hash, Bits: startBits}}
+	if err := CheckBlockContext(block, chain); !errors.Is(err, ErrBadDifficulty) {
+		t.Errorf("CheckBlockContext() error = %v, want %v", err, ErrBadDifficulty)
+	}
+}
+
+func TestForkChoiceByCumulativeWork(t *testing.T) {
+	makeChain := func(length int, bits uint32, tipHash string) []Block {
+		chain := make([]Block, length)
+		for i := range chain {
+			chain[i] = Block{BlockHeader: BlockHeader{Index: i, Bits: bits}, Hash: fmt.Sprintf("%064d", i)}
+		}
+		chain[length-1].Hash = tipHash
+		return chain
+	}
+
+	// Many easy blocks lose against few hard ones
+	long := makeChain(10, 0x207fffff, "aa")
+	short := makeChain(3, 0x1f00ffff, "bb")
+	if !IsBetterChain(short, long) {
+		t.Error("Chain with more work lost against a longer chain")
+	}
+	if IsBetterChain(long, short) {
+		t.Error("Longer chain with less work won")
+	}
+
+	// Equal work is decided by the lower tip hash, regardless of order
+	left := makeChain(4, 0x200fffff, "01")
+	right := makeChain(4, 0x200fffff, "02")
+	if !IsBetterChain(left, right) || IsBetterChain(right, left) {
+		t.Error("Tie was not broken by the lowest tip hash")
+	}
+	if IsBetterChain(left, left) {
+		t.Error("A chain must not be better than itself")
+	}
+
+	// Recorded chain work accumulates the work of every block
+	genesis := CreateGenesisBlock()
+	block := GenerateBlock(genesis, nil, newTestAddress(t), CalcNextBits([]Block{genesis}))
+	if ParseChainWork(block.ChainWork).Cmp(TotalWork([]Block{genesis, block})) != 0 {
+		t.Errorf("Block chain work %s does not match total work", block.ChainWork)
+	}
+}
+
+func TestReorganization(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	receiver := newTestAddress(t)
+	minerA := newTestAddress(t)
+	minerB := newTestAddress(t)
+	useFundedNetwork(t, wallet, Coins(50))
+
+	genesis := CreateGenesisBlock()
+	state := NewBlockchainState()
+	if err := state.AddBlock(genesis); err != nil {
+		t.Fatalf("Failed to add genesis block: %v", err)
+	}
+	var events []ReorgEvent
+	state.SubscribeReorg(func(event ReorgEvent) { events = append(events, event) })
+
+	// Main chain: genesis <- a1 (pays receiver) <- a2
+	funds := state.GetUTXOSet().FindByAddress(wallet.GetAddress())
+	tx, err := wallet.CreateTransaction(funds, receiver, Coins(20), BaseUnitsPerCoin/1000)
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	if err := wallet.SignTransaction(&tx); err != nil {
+		t.Fatalf("Failed to sign transaction: %v", err)
+	}
+	a1 := GenerateBlock(genesis, []Transaction{tx}, minerA, state.GetNextBits())
+	if err := state.AddBlock(a1); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+	a2 := GenerateBlock(a1, nil, minerA, state.GetNextBits())
+	if err := state.AddBlock(a2); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+
+	// Competing branch: genesis <- b1 <- b2 <- b3
+	branch := []Block{genesis}
+	for i := 0; i < 3; i++ {
+		branch = append(branch, GenerateBlock(branch[len(branch)-1], nil, minerB, CalcNextBits(branch)))
+	}
+
+	if err := state.AddBlock(branch[1]); err != nil {
+		t.Fatalf("AddBlock() of a side branch block error = %v", err)
+	}
+	if tip := state.GetLastBlock(); tip.Hash != a2.Hash || len(events) != 0 {
+		t.Fatal("Side branch with less work replaced the main chain")
+	}
+	if err := state.AddBlock(branch[1]); !errors.Is(err, ErrDuplicateBlock) {
+		t.Errorf("AddBlock() of a known block error = %v, want %v", err, ErrDuplicateBlock)
+	}
+
+	if err := state.ReplaceChain(branch); err != nil {
+		t.Fatalf("ReplaceChain() error = %v", err)
+	}
+	if tip := state.GetLastBlock(); tip.Hash != branch[3].Hash {
+		t.Fatalf("Tip = %s, want %s", tip.Hash, branch[3].Hash)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Got %d reorg events, want 1", len(events))
+	}
+	removed := events[0].Removed
+	if len(removed) != 2 || removed[0].Hash != a2.Hash || removed[1].Hash != a1.Hash {
+		t.Errorf("Reorg removed %d blocks, want a2 then a1", len(removed))
+	}
+	if added := events[0].Added; len(added) == 0 || added[0].Hash != branch[1].Hash {
+		t.Error("Reorg did not start connecting at the fork point")
+	}
+
+	// The ledger reflects the new branch only
+	utxos := state.GetUTXOSet()
+	if got := utxos.Balance(minerA); got != 0 {
+		t.Errorf("Disconnected miner balance = %s, want 0", got)
+	}
+	if got := utxos.Balance(receiver); got != 0 {
+		t.Errorf("Receiver balance = %s, want 0", got)
+	}
+	if got := utxos.Balance(wallet.GetAddress()); got != Coins(50) {
+		t.Errorf("Genesis output not restored, balance = %s", got)
+	}
+	if got, want := utxos.Balance(minerB), 3*ActiveNetwork().BlockSubsidy; got != want {
+		t.Errorf("New branch miner balance = %s, want %s", got, want)
+	}
+
+	// The payment from the disconnected block is pending again
+	pending := state.GetPendingTransactions()
+	if len(pending) != 1 || pending[0].TxID != tx.TxID {
+		t.Errorf("Pending transactions = %d, want the disconnected payment", len(pending))
+	}
+}
+
+func TestReorganizationKeepsValidPart(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	state := NewBlockchainState()
+	genesis := CreateGenesisBlock()
+	if err := state.AddBlock(genesis); err != nil {
+		t.Fatalf("Failed to add genesis block: %v", err)
+	}
+	a1 := GenerateBlock(genesis, nil, newTestAddress(t), state.GetNextBits())
+	if err := state.AddBlock(a1); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+	var events []ReorgEvent
+	state.SubscribeChain(func(event ReorgEvent) { events = append(events, event) })
+
+	// b1 and b2 already outweigh a1, but only join the index unconnected, so
+	// the reorg runs when b3 arrives. b3 spends an output that does not exist.
+	missing := UTXO{TxID: strings.Repeat("ab", 32), Amount: Coins(1), Address: wallet.GetAddress()}
+	tx, err := wallet.CreateTransaction([]UTXO{missing}, newTestAddress(t), Coins(1)/2, BaseUnitsPerCoin/1000)
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	if err := wallet.SignTransaction(&tx); err != nil {
+		t.Fatalf("Failed to sign transaction: %v", err)
+	}
+	branch := []Block{genesis}
+	for i := 0; i < 2; i++ {
+		branch = append(branch, GenerateBlock(branch[len(branch)-1], nil, newTestAddress(t), CalcNextBits(branch)))
+	}
+	branch = append(branch, GenerateBlock(branch[2], []Transaction{tx}, newTestAddress(t), CalcNextBits(branch)))
+	node := state.index.Lookup(genesis.Hash)
+	for _, block := range branch[1:3] {
+		node = state.index.Add(block, node)
+	}
+
+	if err := state.AddBlock(branch[3]); err == nil {
+		t.Fatal("AddBlock() accepted a block spending a missing output")
+	}
+	if tip := state.GetLastBlock(); tip.Hash != branch[2].Hash {
+		t.Fatalf("Tip = %d %s, want the valid part of the branch", tip.Index, tip.Hash)
+	}
+	if state.index.Lookup(branch[3].Hash) != nil {
+		t.Error("Invalid block is still indexed")
+	}
+	if len(events) != 1 || len(events[0].Removed) != 1 || len(events[0].Added) != 2 {
+		t.Errorf("Chain events = %+v, want a1 replaced by b1 and b2", events)
+	}
+}
+
+func TestOrphanBlocks(t *testing.T) {
+	miner := newTestAddress(t)
+	genesis := CreateGenesisBlock()
+	chain := []Block{genesis}
+	for i := 0; i < 3; i++ {
+		chain = append(chain, GenerateBlock(chain[len(chain)-1], nil, miner, CalcNextBits(chain)))
+	}
+
+	state := NewBlockchainState()
+	if err := state.AddBlock(genesis); err != nil {
+		t.Fatalf("Failed to add genesis block: %v", err)
+	}
+
+	// Blocks arriving ahead of their parents wait in the orphan pool
+	for _, block := range []Block{chain[3], chain[2]} {
+		if err := state.AddBlock(block); !errors.Is(err, ErrOrphanBlock) {
+			t.Fatalf("AddBlock() of block %d error = %v, want %v", block.Index, err, ErrOrphanBlock)
+		}
+	}
+	if err := state.AddBlock(chain[3]); !errors.Is(err, ErrDuplicateBlock) {
+		t.Errorf("AddBlock() of a known orphan error = %v, want %v", err, ErrDuplicateBlock)
+	}
+	if tip := state.GetLastBlock(); tip.Index != 0 {
+		t.Fatalf("Orphans were connected before their parent, tip = %d", tip.Index)
+	}
+
+	if err := state.AddBlock(chain[1]); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+	if tip := state.GetLastBlock(); tip.Hash != chain[3].Hash {
+		t.Errorf("Tip = %d after the parent arrived, want 3", tip.Index)
+	}
+
+	// The pool is bounded by count and age
+	pool := NewOrphanPool()
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+	for i := 0; i < maxOrphanBlocks+5; i++ {
+		pool.Add(Block{BlockHeader: BlockHeader{PrevHash: "missing"}, Hash: fmt.Sprintf("orphan-%d", i)})
+		now = now.Add(time.Second)
+	}
+	if pool.Len() != maxOrphanBlocks || pool.Has("orphan-0") {
+		t.Errorf("Pool holds %d orphans, want the newest %d", pool.Len(), maxOrphanBlocks)
+	}
+
+	now = now.Add(orphanExpiry)
+	pool.Add(Block{BlockHeader: BlockHeader{PrevHash: "missing"}, Hash: "fresh"})
+	if pool.Len() != 1 {
+		t.Errorf("Expired orphans were not evicted, pool holds %d", pool.Len())
+	}
+	if children := pool.TakeChildren("missing"); len(children) != 1 || pool.Len() != 0 {
+		t.Errorf("TakeChildren() = %d blocks, pool left with %d", len(children), pool.Len())
+	}
+}
+
+func TestBlockValidationErrors(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	useFundedNetwork(t, wallet, Coins(50))
+
+	genesis := CreateGenesisBlock()
+	chain := []Block{genesis}
+	utxos := []UTXO{{TxID: genesis.Transactions[0].TxID, Amount: Coins(50), Address: wallet.GetAddress()}}
+	tx, err := wallet.CreateTransaction(utxos, newTestAddress(t), Coins(10), Coins(1))
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	if err := wallet.SignTransaction(&tx); err != nil {
+		t.Fatalf("Failed to sign transaction: %v", err)
+	}
+
+	valid := GenerateBlock(genesis, []Transaction{tx}, wallet.GetAddress(), CalcNextBits(chain))
+	if err := ValidateBlock(valid, chain); err != nil {
+		t.Fatalf("ValidateBlock() of a valid block error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(block *Block)
+		want   error
+	}{
+		{"tampered hash", func(b *Block) { b.Hash = genesis.Hash }, ErrBadBlockHash},
+		{"missed target", func(b *Block) { b.Bits = 0x1d00ffff; b.Hash = CalculateBlockHash(*b) }, ErrBadProofOfWork},
+		{"stale merkle root", func(b *Block) { b.Transactions = b.Transactions[:1]; b.Hash = MineBlock(b) }, ErrBadMerkleRoot},
+		{"duplicate transaction", func(b *Block) { b.Transactions = append(b.Transactions, tx); remine(b) }, ErrDuplicateTransaction},
+		{"bad signature", func(b *Block) { b.Transactions[1].Signature = nil; remine(b) }, ErrInvalidTransaction},
+		{"future timestamp", func(b *Block) { b.Timestamp = time.Now().Add(3 * time.Hour).Unix(); remine(b) }, ErrTimeTooNew},
+		{"before median time", func(b *Block) { b.Timestamp = genesis.Timestamp - 1; remine(b) }, ErrTimeTooOld},
+		{"wrong parent", func(b *Block) { b.PrevHash = "00"; remine(b) }, ErrBadPrevBlock},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := valid
+			block.Transactions = append([]Transaction(nil), valid.Transactions...)
+			tt.modify(&block)
+			if err := ValidateBlock(block, chain); !errors.Is(err, tt.want) {
+				t.Errorf("ValidateBlock() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeadersFirstSync(t *testing.T) {
+	miner := newTestAddress(t)
+	genesis := CreateGenesisBlock()
+	chain := []Block{genesis}
+	for i := 0; i < 4; i++ {
+		chain = append(chain, GenerateBlock(chain[len(chain)-1], nil, miner, CalcNextBits(chain)))
+	}
+
+	peer := NewBlockchainState()
+	if err := peer.ReplaceChain(chain); err != nil {
+		t.Fatalf("ReplaceChain() error = %v", err)
+	}
+	state := NewBlockchainState()
+	if err := state.ReplaceChain(chain[:2]); err != nil {
+		t.Fatalf("ReplaceChain() error = %v", err)
+	}
+
+	// The peer serves the headers past our locator
+	headers := peer.HeadersAfter(state.BlockLocator(), maxHeadersPerMessage)
+	if len(headers) != 3 || headers[0].BlockHash() != chain[2].Hash {
+		t.Fatalf("HeadersAfter() returned %d headers, want the 3 after block 1", len(headers))
+	}
+	needed, err := state.ProcessHeaders(headers)
+	if err != nil || len(needed) != 3 {
+		t.Fatalf("ProcessHeaders() = %d headers, %v, want 3", len(needed), err)
+	}
+
+	// Bodies must match their headers
+	tampered := chain[2]
+	tampered.Transactions = append([]Transaction(nil), chain[3].Transactions...)
+	if err := CheckBlockBody(needed[0], tampered); !errors.Is(err, ErrBadMerkleRoot) {
+		t.Errorf("CheckBlockBody() of a swapped body error = %v, want %v", err, ErrBadMerkleRoot)
+	}
+	for i, header := range needed {
+		if err := CheckBlockBody(header, chain[i+2]); err != nil {
+			t.Fatalf("CheckBlockBody() error = %v", err)
+		}
+		if err := state.AddBlock(chain[i+2]); err != nil {
+			t.Fatalf("AddBlock() error = %v", err)
+		}
+	}
+	if tip := state.GetLastBlock(); tip.Hash != chain[4].Hash {
+		t.Fatalf("Tip = %s, want %s", tip.Hash, chain[4].Hash)
+	}
+
+	// Once in sync, or offered less work, nothing is downloaded
+	if needed, err := state.ProcessHeaders(headers[:2]); err != nil || needed != nil {
+		t.Errorf("ProcessHeaders() of a shorter header chain = %d headers, %v", len(needed), err)
+	}
+
+	// Invalid headers are rejected before any body is fetched
+	bad := append([]BlockHeader(nil), headers...)
+	bad[1].Bits = 0x1d00ffff
+	if _, err := state.ProcessHeaders(bad); !errors.Is(err, ErrBadProofOfWork) {
+		t.Errorf("ProcessHeaders() of a header missing its target error = %v, want %v", err, ErrBadProofOfWork)
+	}
+	unlinked := []BlockHeader{headers[1], headers[0]}
+	if _, err := state.ProcessHeaders(unlinked); !errors.Is(err, ErrBadPrevBlock) {
+		t.Errorf("ProcessHeaders() of out-of-order headers error = %v, want %v", err, ErrBadPrevBlock)
+	}
+}
+
+func TestGossipDedupAndChainRange(t *testing.T) {
+	filter := newHashFilter(2)
+	if !filter.Add("a") || filter.Add("a") {
+		t.Error("hashFilter did not deduplicate a hash")
+	}
+	filter.Add("b")
+	filter.Add("c")
+	if !filter.Add("a") {
+		t.Error("hashFilter kept more hashes than its limit")
+	}
+
+	// Announcing an item marks it seen, so it is not relayed back
+	state := NewBlockchainState()
+	genesis := CreateGenesisBlock()
+	AnnounceBlock(nil, state, genesis, "")
+	if state.seenBlocks.Add(genesis.Hash) {
+		t.Error("Announced block was not marked as seen")
+	}
+
+	miner := newTestAddress(t)
+	chain := []Block{genesis}
+	for i := 0; i < 3; i++ {
+		chain = append(chain, GenerateBlock(chain[len(chain)-1], nil, miner, CalcNextBits(chain)))
+	}
+
+	// Gossip from a peer without a handshake is dropped and penalized
+	bans, err := NewBanManager(nil, time.Hour)
+	if err != nil {
+		t.Fatalf("NewBanManager() error = %v", err)
+	}
+	state.SetBanManager(bans)
+	handleBlockAnnouncement(nil, state, chain[1], "stranger")
+	if state.index.Lookup(chain[1].Hash) != nil || state.seenBlocks.Has(chain[1].Hash) {
+		t.Error("Block from a peer without a handshake was handled")
+	}
+	if score := bans.Score("stranger"); score >= initialPeerScore {
+		t.Errorf("Score of a peer gossiping without a handshake = %d, want below %d", score, initialPeerScore)
+	}
+
+	// A block claiming another block's hash does not stop the real one
+	if err := state.AddBlock(genesis); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+	state.GetPeers().Add("liar", state.LocalHandshake())
+	state.GetPeers().Add("honest", state.LocalHandshake())
+	forged := chain[1]
+	forged.Nonce++
+	handleBlockAnnouncement(nil, state, forged, "liar")
+	if state.seenBlocks.Has(chain[1].Hash) {
+		t.Error("Block with a forged hash was marked as seen")
+	}
+	if !bans.IsBanned("liar") {
+		t.Error("Peer gossiping a forged hash was not banned")
+	}
+	handleBlockAnnouncement(nil, state, chain[1], "honest")
+	if !state.seenBlocks.Has(chain[1].Hash) || state.GetLastBlock().Hash != chain[1].Hash {
+		t.Error("Real block was not accepted after a forged copy")
+	}
+	if err := state.ReplaceChain(chain); err != nil {
+		t.Fatalf("ReplaceChain() error = %v", err)
+	}
+
+	tests := []struct {
+		start, end, max int
+		want            []Block
+	}{
+		{1, 2, 10, chain[1:3]},
+		{2, 99, 10, chain[2:]},
+		{0, 3, 2, chain[:2]},
+		{5, 9, 10, nil},
+	}
+	for _, tt := range tests {
+		got := state.GetChainRange(tt.start, tt.end, tt.max)
+		if len(got) != len(tt.want) || len(got) > 0 && got[0].Hash != tt.want[0].Hash {
+			t.Errorf("GetChainRange(%d, %d, %d) returned %d blocks, want %d",
+				tt.start, tt.end, tt.max, len(got), len(tt.want))
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	state := NewBlockchainState()
+	genesis := CreateGenesisBlock()
+	if err := state.AddBlock(genesis); err != nil {
+		t.Fatalf("Failed to add genesis block: %v", err)
+	}
+
+	local := state.LocalHandshake()
+	if local.GenesisHash != genesis.Hash || local.BestHeight != 0 || local.ChainWork != genesis.ChainWork {
+		t.Fatalf("LocalHandshake() = %+v does not describe the chain", local)
+	}
+	if err := CheckHandshake(local, local); err != nil {
+		t.Errorf("CheckHandshake() of a matching peer error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Handshake)
+		want   error
+	}{
+		{"old version", func(hs *Handshake) { hs.Version = MinProtocolVersion - 1 }, ErrIncompatibleVersion},
+		{"other chain", func(hs *Handshake) { hs.ChainID = "other" }, ErrWrongNetwork},
+		{"other genesis", func(hs *Handshake) { hs.GenesisHash = "00" }, ErrWrongNetwork},
+	}
+	for _, tt := range tests {
+		remote := local
+		tt.modify(&remote)
+		if err := CheckHandshake(local, remote); !errors.Is(err, tt.want) {
+			t.Errorf("CheckHandshake() with %s error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	peers := NewPeerSet()
+	peers.Add("peer", local)
+	if info, ok := peers.Get("peer"); !ok || !info.HasFeature(FeatureHeaders) {
+		t.Error("PeerSet did not keep the peer's handshake")
+	}
+	peers.Remove("peer")
+	if _, ok := peers.Get("peer"); ok {
+		t.Error("PeerSet kept a removed peer")
+	}
+}
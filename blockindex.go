@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math/big"
+)
+
+// blockNode is a block in the block index together with its position in
+// the block tree
+type blockNode struct {
+	block  Block
+	parent *blockNode
+	work   *big.Int // Cumulative work from genesis up to this block
+}
+
+func (n *blockNode) height() int {
+	return n.block.Index
+}
+
+// isBetterThan applies the fork-choice rule of IsBetterChain to two tips
+func (n *blockNode) isBetterThan(other *blockNode) bool {
+	if other == nil {
+		return true
+	}
+	if cmp := n.work.Cmp(other.work); cmp != 0 {
+		return cmp > 0
+	}
+	return n.block.Hash < other.block.Hash
+}
+
+// BlockIndex keeps every known valid-looking block, including blocks of
+// competing side branches. It is not safe for concurrent use.
+type BlockIndex struct {
+	nodes map[string]*blockNode
+}
+
+func NewBlockIndex() *BlockIndex {
+	return &BlockIndex{
+		nodes: make(map[string]*blockNode),
+	}
+}
+
+// Lookup returns the node of a block hash, or nil if unknown
+func (bi *BlockIndex) Lookup(hash string) *blockNode {
+	return bi.nodes[hash]
+}
+
+// Add inserts a block whose parent is already indexed (or a genesis block)
+func (bi *BlockIndex) Add(block Block, parent *blockNode) *blockNode {
+	work := CalcWork(block.Bits)
+	if parent != nil {
+		work.Add(work, parent.work)
+	}
+
+	node := &blockNode{block: block, parent: parent, work: work}
+	bi.nodes[block.Hash] = node
+	return node
+}
+
+// Remove drops a block and every descendant of it from the index and
+// returns their hashes
+func (bi *BlockIndex) Remove(hash string) []string {
+	removed := map[string]bool{hash: true}
+	delete(bi.nodes, hash)
+
+	// Descendants are removed once their parent is gone
+	for changed := true; changed; {
+		changed = false
+		for h, node := range bi.nodes {
+			if node.parent != nil && removed[node.parent.block.Hash] {
+				removed[h] = true
+				delete(bi.nodes, h)
+				changed = true
+			}
+		}
+	}
+
+	hashes := make([]string, 0, len(removed))
+	for h := range removed {
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
+
+// Len returns the number of indexed blocks
+func (bi *BlockIndex) Len() int {
+	return len(bi.nodes)
+}
@@ -1,6 +1,6 @@
 package main
 
-
+import "fmt"
 
 const (
 	BlockProtocol = "/block/1.0.0"
@@ -8,25 +8,70 @@ const (
 	ChainProtocol = "/chain/1.0.0"
 )
 
+// MessageType identifies the payload of a frame, see WriteFrame
+type MessageType byte
+
+// Message types
+const (
+	MsgVersion    MessageType = iota + 1 // Payload: handshake, see EncodeHandshake
+	MsgGetBlock                          // Payload: block hash
+	MsgBlock                             // Payload: encoded block, see EncodeBlock
+	MsgNotFound                          // Payload: requested hash
+	MsgGetHeaders                        // Payload: block locator, see BlockLocator and encodeHashes
+	MsgHeaders                           // Payload: encoded headers, see encodeHeaders
+	MsgTx                                // Payload: encoded transaction, see EncodeTransaction
+	MsgGetChain                          // Payload: encoded ChainRange
+	MsgChain                             // Payload: encoded blocks, see encodeChain
+	MsgGetBlocks                         // Payload: encoded GetBlocks
+	MsgInv                               // Payload: block hashes, see encodeHashes
+	MsgGetData                           // Payload: block hashes, see encodeHashes
+)
+
+var messageTypeNames = map[MessageType]string{
+	MsgVersion:    "version",
+	MsgGetBlock:   "getblock",
+	MsgBlock:      "block",
+	MsgNotFound:   "notfound",
+	MsgGetHeaders: "getheaders",
+	MsgHeaders:    "headers",
+	MsgTx:         "tx",
+	MsgGetChain:   "getchain",
+	MsgChain:      "chain",
+	MsgGetBlocks:  "getblocks",
+	MsgInv:        "inv",
+	MsgGetData:    "getdata",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+// Message is one frame on a P2P stream
 type Message struct {
-	Type    string      `json:"type"`
-	Payload interface{} `json:"payload"`
+	Type    MessageType
+	Payload []byte
 }
 
 type BlockchainDB interface {
 	SaveBlock(block Block) error
+	StoreBlock(block Block) error
+	DeleteBlocks(hashes []string) error
 	GetBlock(hash string) (Block, error)
 	SaveChain(chain []Block) error
 	LoadChain() ([]Block, error)
+	LoadBlocks() ([]Block, error)
 }
 
+// SelectBestChain returns the valid chain with the most cumulative work,
+// breaking ties by the lowest tip hash
 func SelectBestChain(chains [][]Block) []Block {
 	var bestChain []Block
-	maxLength := 0
 
 	for _, chain := range chains {
-		if len(chain) > maxLength && ValidateBlockchain(chain) {
-			maxLength = len(chain)
+		if IsBetterChain(chain, bestChain) && ValidateBlockchain(chain) {
 			bestChain = chain
 		}
 	}
@@ -1,24 +1,37 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"time"
+	"os"
+	"strconv"
+	"strings"
 )
 
 type CLI struct {
 	baseURL string
+	input   *bufio.Reader
 }
 
 func NewCLI(port string) *CLI {
 	return &CLI{
 		baseURL: fmt.Sprintf("http://localhost:%s", port),
+		input:   bufio.NewReader(os.Stdin),
 	}
 }
 
+// prompt prints label and reads one line of input, which may be empty
+func (cli *CLI) prompt(label string) string {
+	fmt.Print(label)
+	line, _ := cli.input.ReadString('\n')
+	return strings.TrimSpace(line)
+}
+
 func (cli *CLI) Start() {
 	for {
 		fmt.Println("\n🚀 Blockchain CLI")
@@ -26,11 +39,10 @@ func (cli *CLI) Start() {
 		fmt.Println("2. Create transaction")
 		fmt.Println("3. Mine block")
 		fmt.Println("4. View peers")
-		fmt.Println("5. Exit")
+		fmt.Println("5. View balance")
+		fmt.Println("6. Exit")
 
-		var choice int
-		fmt.Print("Enter choice (1-5): ")
-		fmt.Scan(&choice)
+		choice, _ := strconv.Atoi(cli.prompt("Enter choice (1-6): "))
 
 		switch choice {
 		case 1:
@@ -42,6 +54,8 @@ func (cli *CLI) Start() {
 		case 4:
 			cli.viewPeers()
 		case 5:
+			cli.viewBalance()
+		case 6:
 			return
 		}
 	}
@@ -69,23 +83,45 @@ func (cli *CLI) viewBlockchain() {
 	}
 }
 
+// createTransaction asks for a payment. Without a fee the node pays the
+// estimated fee rate for confirmation within the given number of blocks.
 func (cli *CLI) createTransaction() {
-	tx := Transaction{
-		Receiver:  "recipient123",
-		Amount:    10.0,
-		Timestamp: time.Now(),
+	var req TransactionRequest
+	var err error
+	req.Receiver = cli.prompt("Receiver address: ")
+	if req.Amount, err = ParseAmount(cli.prompt("Amount: ")); err != nil {
+		fmt.Printf("\n❌ %v\n", err)
+		return
+	}
+	if fee := cli.prompt("Fee (empty to use the estimate): "); fee != "" {
+		if req.Fee, err = ParseAmount(fee); err != nil {
+			fmt.Printf("\n❌ %v\n", err)
+			return
+		}
+	} else if target := cli.prompt(fmt.Sprintf("Confirm within blocks (empty for %d): ", defaultConfirmTarget)); target != "" {
+		if req.ConfTarget, err = strconv.Atoi(target); err != nil {
+			fmt.Printf("\n❌ Invalid confirmation target %q\n", target)
+			return
+		}
 	}
 
-	jsonData, _ := json.Marshal(tx)
+	jsonData, _ := json.Marshal(req)
 	resp, err := http.Post(cli.baseURL+"/transaction", "application/json",
 		bytes.NewBuffer(jsonData))
 	if err != nil {
 		log.Fatal("Error creating transaction:", err)
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Printf("\n❌ Transaction rejected: %s\n", bytes.TrimSpace(body))
+		return
+	}
 
 	var result Transaction
 	json.NewDecoder(resp.Body).Decode(&result)
-	fmt.Printf("\n✅ Transaction created: %s\n", result.TxID)
+	fmt.Printf("\n✅ Transaction created: %s (fee %s)\n", result.TxID, result.Fee)
 }
 
 func (cli *CLI) mineBlock() {
@@ -100,6 +136,24 @@ func (cli *CLI) mineBlock() {
 	fmt.Printf("Hash: %s\n", block.Hash)
 }
 
+func (cli *CLI) viewBalance() {
+	resp, err := http.Get(cli.baseURL + "/balance")
+	if err != nil {
+		log.Printf("Error fetching balance: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var balance BalanceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&balance); err != nil {
+		log.Printf("Error decoding balance: %v\n", err)
+		return
+	}
+
+	fmt.Printf("\n👛 Address: %s\n", balance.Address)
+	fmt.Printf("Balance: %s (%d unspent outputs)\n", balance.Balance, len(balance.UTXOs))
+}
+
 func (cli *CLI) viewPeers() {
 	resp, err := http.Get(cli.baseURL + "/peers")
 	if err != nil {
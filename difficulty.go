@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+)
+
+// Difficulty is expressed as a compact target ("bits"): the top byte is a
+// base-256 exponent and the low 23 bits the mantissa, as in Bitcoin. A block
+// is valid when its hash, read as a 256-bit big-endian integer, is at most
+// the target. Halving the target doubles the expected work.
+
+// CompactToBig expands compact bits into the full target
+func CompactToBig(bits uint32) *big.Int {
+	mantissa := int64(bits & 0x007fffff)
+	negative := bits&0x00800000 != 0
+	exponent := uint(bits >> 24)
+
+	target := big.NewInt(mantissa)
+	if exponent <= 3 {
+		target.Rsh(target, 8*(3-exponent))
+	} else {
+		target.Lsh(target, 8*(exponent-3))
+	}
+
+	if negative {
+		target.Neg(target)
+	}
+	return target
+}
+
+// BigToCompact encodes a target as compact bits, dropping precision beyond
+// the 23-bit mantissa
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(target.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		shifted := new(big.Int).Rsh(target, 8*(exponent-3))
+		mantissa = uint32(shifted.Bits()[0])
+	}
+
+	// The sign bit is part of the mantissa, so move a set high bit into
+	// the exponent instead
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	bits := uint32(exponent<<24) | mantissa
+	if target.Sign() < 0 {
+		bits |= 0x00800000
+	}
+	return bits
+}
+
+// HashToBig interprets a hex block hash as a big-endian integer
+func HashToBig(hash string) (*big.Int, error) {
+	raw, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block hash %q: %w", hash, err)
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// CheckProofOfWork verifies the hash is at or below the target of bits and
+// that the target itself is within the network's proof-of-work limit
+func CheckProofOfWork(hash string, bits uint32) error {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return fmt.Errorf("target 0x%08x is not positive", bits)
+	}
+	if target.Cmp(CompactToBig(activeParams.PowLimitBits)) > 0 {
+		return fmt.Errorf("target 0x%08x is above the proof-of-work limit", bits)
+	}
+
+	hashNum, err := HashToBig(hash)
+	if err != nil {
+		return err
+	}
+	if hashNum.Cmp(target) > 0 {
+		return fmt.Errorf("hash %s does not meet target 0x%08x", hash, bits)
+	}
+	return nil
+}
+
+// CalcNextBits returns the bits the block following chain must carry. The
+// chain is the ancestry of the new block, ending at its parent.
+func CalcNextBits(chain []Block) uint32 {
+	return CalcNextHeaderBits(headerTail(chain))
+}
+
+// CalcNextHeaderBits returns the bits the header following headers must
+// carry. Every RetargetInterval blocks the target is scaled by how long the
+// last interval actually took compared to RetargetInterval*TargetBlockTime,
+// limited to a factor of four either way. Only the last RetargetInterval
+// headers are looked at.
+func CalcNextHeaderBits(headers []BlockHeader) uint32 {
+	params := activeParams
+	if len(headers) == 0 {
+		return params.GenesisBits
+	}
+
+	prev := headers[len(headers)-1]
+	height := prev.Index + 1
+	if params.RetargetInterval <= 0 || height%params.RetargetInterval != 0 ||
+		len(headers) < params.RetargetInterval {
+		return prev.Bits
+	}
+
+	first := headers[len(headers)-params.RetargetInterval]
+	expected := int64(params.RetargetInterval) * params.TargetBlockTime
+	actual := prev.Timestamp - first.Timestamp
+	if actual < expected/4 {
+		actual = expected / 4
+	}
+	if actual > expected*4 {
+		actual = expected * 4
+	}
+
+	target := CompactToBig(prev.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	if powLimit := CompactToBig(params.PowLimitBits); target.Cmp(powLimit) > 0 {
+		target = powLimit
+	}
+	return BigToCompact(target)
+}
+
+// CalcWork returns the expected number of hashes needed to meet the target
+// of bits: 2^256 / (target + 1)
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+	return numerator.Div(numerator, denominator)
+}
+
+// ParseChainWork decodes the hex chain work recorded in a block. An empty
+// value is treated as zero work.
+func ParseChainWork(chainWork string) *big.Int {
+	work, ok := new(big.Int).SetString(chainWork, 16)
+	if !ok {
+		return big.NewInt(0)
+	}
+	return work
+}
+
+// CalcChainWork returns the chain work a child of prev with the given bits
+// must record
+func CalcChainWork(prev Block, bits uint32) string {
+	work := ParseChainWork(prev.ChainWork)
+	work.Add(work, CalcWork(bits))
+	return work.Text(16)
+}
+
+// TotalWork sums the work of every block in the chain from their bits,
+// without trusting the recorded chain work
+func TotalWork(chain []Block) *big.Int {
+	total := big.NewInt(0)
+	for _, block := range chain {
+		total.Add(total, CalcWork(block.Bits))
+	}
+	return total
+}
+
+// IsBetterChain reports whether candidate should replace current as the
+// best chain: it carries more total work or, on equal work, its tip hash
+// sorts lower. This is the single fork-choice rule every sync path uses.
+func IsBetterChain(candidate, current []Block) bool {
+	if len(candidate) == 0 {
+		return false
+	}
+	if len(current) == 0 {
+		return true
+	}
+
+	if cmp := TotalWork(candidate).Cmp(TotalWork(current)); cmp != 0 {
+		return cmp > 0
+	}
+	return candidate[len(candidate)-1].Hash < current[len(current)-1].Hash
+}
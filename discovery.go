@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Besides mDNS, which only reaches the local network segment, a node finds
+// peers in three ways:
+//
+//   - Bootstrap peers given on the command line are dialed at startup and
+//     redialed with exponential backoff whenever the connection drops.
+//   - Peers in the address book are dialed once at startup.
+//   - With DHT discovery enabled, the node joins a Kademlia DHT of its own
+//     (not the public IPFS one), advertises itself under a rendezvous
+//     namespace that includes the chain ID, and connects to the other
+//     providers of that namespace.
+//
+// Every peer found goes through connectPeer, so it is handshaken with and,
+// once accepted, recorded in the address book with the addresses it was
+// found at.
+
+const (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 5 * time.Minute
+	peerCheckInterval   = 10 * time.Second // How often a live bootstrap connection is checked
+
+	dhtProtocolPrefix    = "/blockchain-mvp"
+	dhtMinLookupInterval = 5 * time.Second
+	dhtMaxLookupInterval = 5 * time.Minute
+)
+
+// RendezvousNamespace returns the DHT namespace under which the nodes of a
+// chain find each other
+func RendezvousNamespace(chainID string) string {
+	return "blockchain-mvp/" + chainID
+}
+
+// ParseBootstrapPeers parses a comma-separated list of multiaddrs, each
+// ending in /p2p/<peer ID>. Addresses of the same peer are merged.
+func ParseBootstrapPeers(list string) ([]peer.AddrInfo, error) {
+	var addrs []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			addrs = append(addrs, s)
+		}
+	}
+
+	var peers []peer.AddrInfo
+	index := make(map[peer.ID]int)
+	for _, s := range addrs {
+		info, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap peer %q: %w", s, err)
+		}
+		if i, ok := index[info.ID]; ok {
+			peers[i].Addrs = ma.Unique(append(peers[i].Addrs, info.Addrs...))
+			continue
+		}
+		index[info.ID] = len(peers)
+		peers = append(peers, *info)
+	}
+	return peers, nil
+}
+
+// ConnectBootstrapPeers keeps the node connected to each bootstrap peer until
+// ctx is done
+func ConnectBootstrapPeers(ctx context.Context, h host.Host, state *BlockchainState, peers []peer.AddrInfo) {
+	for _, pi := range peers {
+		if pi.ID == h.ID() {
+			continue
+		}
+		fmt.Printf("🥾 Bootstrap peer: %s\n", pi.ID)
+		go maintainPeer(ctx, h, state, pi)
+	}
+}
+
+// maintainPeer connects to a peer and reconnects whenever the connection is
+// lost, doubling the wait after each failed attempt
+func maintainPeer(ctx context.Context, h host.Host, state *BlockchainState, pi peer.AddrInfo) {
+	backoff := reconnectMinBackoff
+	for {
+		wait := peerCheckInterval
+		if h.Network().Connectedness(pi.ID) != network.Connected {
+			if err := connectPeer(h, state, pi); err != nil {
+				wait = backoff
+				backoff = min(2*backoff, reconnectMaxBackoff)
+				fmt.Printf("🔁 Retrying bootstrap peer %s in %s\n", pi.ID, wait)
+			} else {
+				backoff = reconnectMinBackoff
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// DialKnownPeers dials every peer in the address book once
+func DialKnownPeers(h host.Host, state *BlockchainState) {
+	book := state.GetAddressBook()
+	if book == nil {
+		return
+	}
+	for _, pi := range book.Peers() {
+		if pi.ID == h.ID() {
+			continue
+		}
+		go connectPeer(h, state, pi)
+	}
+}
+
+// StartDHTDiscovery joins the DHT through the bootstrap peers, then
+// advertises the node under the rendezvous namespace of the active chain and
+// connects to the other nodes found there, until ctx is done. Every node
+// runs in server mode, so nodes on a private or loopback network can find
+// each other.
+func StartDHTDiscovery(ctx context.Context, h host.Host, state *BlockchainState, bootstrap []peer.AddrInfo) (*dht.IpfsDHT, error) {
+	kdht, err := dht.New(ctx, h,
+		dht.Mode(dht.ModeServer),
+		dht.ProtocolPrefix(dhtProtocolPrefix),
+		dht.BootstrapPeers(bootstrap...),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DHT: %w", err)
+	}
+	if err := kdht.Bootstrap(ctx); err != nil {
+		kdht.Close()
+		return nil, fmt.Errorf("failed to bootstrap DHT: %w", err)
+	}
+
+	namespace := RendezvousNamespace(activeParams.ChainID)
+	go runDHTDiscovery(ctx, h, state, kdht, namespace)
+	fmt.Printf("✅ DHT discovery started with namespace: %s\n", namespace)
+	return kdht, nil
+}
+
+// runDHTDiscovery advertises the node and looks up the namespace. Lookups
+// back off while they find nobody new and speed up again once they do.
+func runDHTDiscovery(ctx context.Context, h host.Host, state *BlockchainState, kdht *dht.IpfsDHT, namespace string) {
+	rd := drouting.NewRoutingDiscovery(kdht)
+	var advertiseAt time.Time
+	interval := dhtMinLookupInterval
+
+	for {
+		// Nothing can be advertised or found before the routing table has
+		// a peer
+		if kdht.RoutingTable().Size() > 0 {
+			if time.Now().After(advertiseAt) {
+				if ttl, err := rd.Advertise(ctx, namespace); err != nil {
+					fmt.Printf("❌ Failed to advertise on the DHT: %v\n", err)
+				} else {
+					advertiseAt = time.Now().Add(ttl / 2)
+				}
+			}
+
+			if findDHTPeers(ctx, h, state, rd, namespace) > 0 {
+				interval = dhtMinLookupInterval
+			} else {
+				interval = min(2*interval, dhtMaxLookupInterval)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// findDHTPeers connects to the providers of namespace that the node has no
+// handshake with and returns how many it found. Providers it already has a
+// handshake with are only recorded in the address book.
+func findDHTPeers(ctx context.Context, h host.Host, state *BlockchainState, rd *drouting.RoutingDiscovery, namespace string) int {
+	lookupCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	found, err := rd.FindPeers(lookupCtx, namespace)
+	if err != nil {
+		fmt.Printf("❌ DHT lookup failed: %v\n", err)
+		return 0
+	}
+
+	count := 0
+	for pi := range found {
+		if pi.ID == h.ID() || len(pi.Addrs) == 0 {
+			continue
+		}
+		if _, ok := state.GetPeers().Get(pi.ID); ok {
+			recordPeer(state, pi)
+			continue
+		}
+		count++
+		fmt.Printf("🎯 Peer found on the DHT: %s\n", pi.ID)
+		go connectPeer(h, state, pi)
+	}
+	return count
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// newTestNode starts a node with a fresh chain listening on a random
+// loopback port
+func newTestNode(t *testing.T, book *AddressBook) (host.Host, *BlockchainState) {
+	t.Helper()
+	state := NewBlockchainState()
+	if err := state.AddBlock(CreateGenesisBlock()); err != nil {
+		t.Fatalf("Failed to add genesis block: %v", err)
+	}
+	state.SetAddressBook(book)
+
+	key, err := GenerateNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := CreateLibp2pHost("0", key, nil)
+	if err != nil {
+		t.Fatalf("CreateLibp2pHost() error = %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	state.SetP2PHost(h)
+	SetupStreamHandler(h, state)
+	SetupBlockHandler(h, state)
+	SetupGossipHandlers(h, state)
+	return h, state
+}
+
+// loopbackAddr returns the loopback multiaddr of a host, as given to -bootstrap
+func loopbackAddr(t *testing.T, h host.Host) string {
+	t.Helper()
+	for _, addr := range h.Addrs() {
+		if s := addr.String(); strings.HasPrefix(s, "/ip4/127.0.0.1/") {
+			return fmt.Sprintf("%s/p2p/%s", s, h.ID())
+		}
+	}
+	t.Fatalf("Host has no loopback address: %v", h.Addrs())
+	return ""
+}
+
+// waitForPeer waits until state holds a handshake with id and has it in its
+// address book
+func waitForPeer(t *testing.T, state *BlockchainState, id peer.ID, what string) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := state.GetPeers().Get(id); ok && knownPeer(state.GetAddressBook(), id) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("No handshake with %s", what)
+}
+
+// knownPeer reports whether the address book has addresses of id
+func knownPeer(book *AddressBook, id peer.ID) bool {
+	for _, pi := range book.Peers() {
+		if pi.ID == id {
+			return len(pi.Addrs) > 0
+		}
+	}
+	return false
+}
+
+func TestBootstrapAndDHTDiscovery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts several libp2p hosts")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	dir := t.TempDir()
+	db, err := OpenBoltDB(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	book, err := NewAddressBook(db)
+	if err != nil {
+		t.Fatalf("NewAddressBook() error = %v", err)
+	}
+
+	hostA, stateA := newTestNode(t, nil)
+	hostB, stateB := newTestNode(t, nil)
+	hostC, stateC := newTestNode(t, book)
+
+	bootstrap, err := ParseBootstrapPeers(loopbackAddr(t, hostA) + ", " + loopbackAddr(t, hostA))
+	if err != nil || len(bootstrap) != 1 {
+		t.Fatalf("ParseBootstrapPeers() = %v, %v, want one peer", bootstrap, err)
+	}
+	if _, err := ParseBootstrapPeers("/ip4/127.0.0.1/tcp/1"); err == nil {
+		t.Error("ParseBootstrapPeers() accepted an address without a peer ID")
+	}
+
+	// B and C only know A; C finds B through the DHT
+	for _, node := range []struct {
+		h     host.Host
+		state *BlockchainState
+		peers []peer.AddrInfo
+	}{
+		{hostA, stateA, nil},
+		{hostB, stateB, bootstrap},
+		{hostC, stateC, bootstrap},
+	} {
+		ConnectBootstrapPeers(ctx, node.h, node.state, node.peers)
+		kdht, err := StartDHTDiscovery(ctx, node.h, node.state, node.peers)
+		if err != nil {
+			t.Fatalf("StartDHTDiscovery() error = %v", err)
+		}
+		t.Cleanup(func() { kdht.Close() })
+	}
+
+	waitForPeer(t, stateC, hostA.ID(), "the bootstrap peer")
+	waitForPeer(t, stateC, hostB.ID(), "the peer found on the DHT")
+
+	// Both peers are remembered across restarts
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db, err = OpenBoltDB(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	restored, err := NewAddressBook(db)
+	if err != nil {
+		t.Fatalf("NewAddressBook() error = %v", err)
+	}
+	if !knownPeer(restored, hostA.ID()) || !knownPeer(restored, hostB.ID()) {
+		t.Errorf("Address book after a restart = %v, want A and B with addresses", restored.Peers())
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Blocks and transactions have a single canonical binary encoding, used for
+// hashing, signing, TxIDs, storage and the wire protocol. Every encoding
+// starts with a version byte. Integers, including amounts in base units, are
+// fixed-width big-endian, and strings and byte slices carry a uint32 length
+// prefix, so no two different values share an encoding.
+const encodingVersion byte = 1
+
+// Smallest encodings of collection elements, see decoder.count
+var (
+	minEncodedTransaction = len(EncodeTransaction(Transaction{}))
+	minEncodedHeader      = len(EncodeBlockHeader(BlockHeader{}))
+	minEncodedBlock       = len(EncodeBlock(Block{}))
+)
+
+const (
+	minEncodedString = 4     // Length prefix
+	minEncodedInput  = 4 + 8 // TxID and output index
+	minEncodedOutput = 4 + 8 // Address and amount
+)
+
+// Encoding errors
+var (
+	ErrUnknownEncodingVersion = errors.New("unknown encoding version")
+	ErrTruncatedEncoding      = errors.New("encoding is truncated")
+	ErrTrailingBytes          = errors.New("encoding has trailing bytes")
+)
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uint8(v byte) {
+	e.buf.WriteByte(v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.buf.Write(v)
+}
+
+func (e *encoder) string(v string) {
+	e.bytes([]byte(v))
+}
+
+func (e *encoder) time(v time.Time) {
+	e.int64(v.Unix())
+	e.uint32(uint32(v.Nanosecond()))
+}
+
+// decoder reads what encoder wrote. The first error sticks and makes every
+// later read return zero values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) read(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = ErrTruncatedEncoding
+		return nil
+	}
+	v := d.data[:n]
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) uint8() byte {
+	if b := d.read(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.read(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.read(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) bytes() []byte {
+	b := d.read(int(d.uint32()))
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func (d *decoder) string() string {
+	return string(d.read(int(d.uint32())))
+}
+
+func (d *decoder) time() time.Time {
+	sec := d.int64()
+	nsec := d.uint32()
+	return time.Unix(sec, int64(nsec)).UTC()
+}
+
+// count reads a collection length, rejecting lengths the remaining data
+// cannot hold at minSize encoded bytes per element. Callers allocate the
+// collection up front, so this bounds memory by the size of the data.
+func (d *decoder) count(minSize int) int {
+	n := d.uint32()
+	if d.err == nil && int64(n)*int64(minSize) > int64(len(d.data)) {
+		d.err = ErrTruncatedEncoding
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) version() {
+	if v := d.uint8(); d.err == nil && v != encodingVersion {
+		d.err = fmt.Errorf("%w: %d", ErrUnknownEncodingVersion, v)
+	}
+}
+
+// finish returns the first error, or ErrTrailingBytes if data is left over
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		return ErrTrailingBytes
+	}
+	return d.err
+}
+
+// EncodeBlockHeader encodes a header, the preimage of the block hash
+func EncodeBlockHeader(header BlockHeader) []byte {
+	var e encoder
+	encodeBlockHeader(&e, header)
+	return e.buf.Bytes()
+}
+
+// DecodeBlockHeader decodes EncodeBlockHeader
+func DecodeBlockHeader(data []byte) (BlockHeader, error) {
+	d := &decoder{data: data}
+	header := decodeBlockHeader(d)
+	if err := d.finish(); err != nil {
+		return BlockHeader{}, fmt.Errorf("failed to decode block header: %w", err)
+	}
+	return header, nil
+}
+
+// EncodeBlock encodes the header followed by the hash, chain work and
+// transactions
+func EncodeBlock(block Block) []byte {
+	var e encoder
+	encodeBlockHeader(&e, block.BlockHeader)
+	e.string(block.Hash)
+	e.string(block.ChainWork)
+	e.uint32(uint32(len(block.Transactions)))
+	for _, tx := range block.Transactions {
+		encodeTransaction(&e, tx, false)
+	}
+	return e.buf.Bytes()
+}
+
+// DecodeBlock decodes EncodeBlock
+func DecodeBlock(data []byte) (Block, error) {
+	d := &decoder{data: data}
+	block := Block{BlockHeader: decodeBlockHeader(d)}
+	block.Hash = d.string()
+	block.ChainWork = d.string()
+	if n := d.count(minEncodedTransaction); n > 0 {
+		block.Transactions = make([]Transaction, n)
+		for i := range block.Transactions {
+			block.Transactions[i] = decodeTransaction(d)
+		}
+	}
+	if err := d.finish(); err != nil {
+		return Block{}, fmt.Errorf("failed to decode block: %w", err)
+	}
+	return block, nil
+}
+
+// EncodeTransaction encodes a signed transaction
+func EncodeTransaction(tx Transaction) []byte {
+	var e encoder
+	encodeTransaction(&e, tx, false)
+	return e.buf.Bytes()
+}
+
+// DecodeTransaction decodes EncodeTransaction
+func DecodeTransaction(data []byte) (Transaction, error) {
+	d := &decoder{data: data}
+	tx := decodeTransaction(d)
+	if err := d.finish(); err != nil {
+		return Transaction{}, fmt.Errorf("failed to decode transaction: %w", err)
+	}
+	return tx, nil
+}
+
+// encodeChain encodes a run of blocks for the wire
+func encodeChain(chain []Block) []byte {
+	var e encoder
+	e.uint32(uint32(len(chain)))
+	for _, block := range chain {
+		e.bytes(EncodeBlock(block))
+	}
+	return e.buf.Bytes()
+}
+
+// decodeChain decodes encodeChain
+func decodeChain(data []byte) ([]Block, error) {
+	d := &decoder{data: data}
+	chain := make([]Block, d.count(4+minEncodedBlock))
+	for i := range chain {
+		block, err := DecodeBlock(d.bytes())
+		if err != nil {
+			return nil, err
+		}
+		chain[i] = block
+	}
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("failed to decode blocks: %w", err)
+	}
+	return chain, nil
+}
+
+// encodeHeaders encodes a run of headers for the wire
+func encodeHeaders(headers []BlockHeader) []byte {
+	var e encoder
+	e.uint32(uint32(len(headers)))
+	for _, header := range headers {
+		e.bytes(EncodeBlockHeader(header))
+	}
+	return e.buf.Bytes()
+}
+
+// decodeHeaders decodes encodeHeaders
+func decodeHeaders(data []byte) ([]BlockHeader, error) {
+	d := &decoder{data: data}
+	headers := make([]BlockHeader, d.count(4+minEncodedHeader))
+	for i := range headers {
+		header, err := DecodeBlockHeader(d.bytes())
+		if err != nil {
+			return nil, err
+		}
+		headers[i] = header
+	}
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("failed to decode headers: %w", err)
+	}
+	return headers, nil
+}
+
+// encodeHashes encodes a list of hashes, such as a block locator
+func encodeHashes(hashes []string) []byte {
+	var e encoder
+	e.uint32(uint32(len(hashes)))
+	for _, hash := range hashes {
+		e.string(hash)
+	}
+	return e.buf.Bytes()
+}
+
+// decodeHashes decodes encodeHashes
+func decodeHashes(data []byte) ([]string, error) {
+	d := &decoder{data: data}
+	hashes := make([]string, d.count(minEncodedString))
+	for i := range hashes {
+		hashes[i] = d.string()
+	}
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("failed to decode hashes: %w", err)
+	}
+	return hashes, nil
+}
+
+// encodeChainRange encodes a getchain request
+func encodeChainRange(r ChainRange) []byte {
+	var e encoder
+	e.int64(int64(r.Start))
+	e.int64(int64(r.End))
+	return e.buf.Bytes()
+}
+
+// decodeChainRange decodes encodeChainRange
+func decodeChainRange(data []byte) (ChainRange, error) {
+	d := &decoder{data: data}
+	r := ChainRange{Start: int(d.int64()), End: int(d.int64())}
+	if err := d.finish(); err != nil {
+		return ChainRange{}, fmt.Errorf("failed to decode chain range: %w", err)
+	}
+	return r, nil
+}
+
+// encodeGetBlocks encodes a getblocks request
+func encodeGetBlocks(req GetBlocks) []byte {
+	var e encoder
+	e.uint32(uint32(len(req.Locator)))
+	for _, hash := range req.Locator {
+		e.string(hash)
+	}
+	e.string(req.Stop)
+	return e.buf.Bytes()
+}
+
+// decodeGetBlocks decodes encodeGetBlocks
+func decodeGetBlocks(data []byte) (GetBlocks, error) {
+	d := &decoder{data: data}
+	var req GetBlocks
+	if n := d.count(minEncodedString); n > 0 {
+		req.Locator = make([]string, n)
+		for i := range req.Locator {
+			req.Locator[i] = d.string()
+		}
+	}
+	req.Stop = d.string()
+	if err := d.finish(); err != nil {
+		return GetBlocks{}, fmt.Errorf("failed to decode getblocks: %w", err)
+	}
+	return req, nil
+}
+
+// EncodeHandshake encodes a handshake
+func EncodeHandshake(hs Handshake) []byte {
+	var e encoder
+	e.uint8(encodingVersion)
+	e.int64(int64(hs.Version))
+	e.string(hs.ChainID)
+	e.string(hs.GenesisHash)
+	e.int64(int64(hs.BestHeight))
+	e.string(hs.ChainWork)
+	e.uint32(uint32(len(hs.Features)))
+	for _, feature := range hs.Features {
+		e.string(feature)
+	}
+	return e.buf.Bytes()
+}
+
+// DecodeHandshake decodes EncodeHandshake
+func DecodeHandshake(data []byte) (Handshake, error) {
+	d := &decoder{data: data}
+	d.version()
+	hs := Handshake{
+		Version:     int(d.int64()),
+		ChainID:     d.string(),
+		GenesisHash: d.string(),
+		BestHeight:  int(d.int64()),
+		ChainWork:   d.string(),
+	}
+	if n := d.count(minEncodedString); n > 0 {
+		hs.Features = make([]string, n)
+		for i := range hs.Features {
+			hs.Features[i] = d.string()
+		}
+	}
+	if err := d.finish(); err != nil {
+		return Handshake{}, fmt.Errorf("failed to decode handshake: %w", err)
+	}
+	return hs, nil
+}
+
+// encodeAddrEntry encodes an address book entry
+func encodeAddrEntry(entry AddrEntry) []byte {
+	var e encoder
+	e.uint8(encodingVersion)
+	e.time(entry.LastSeen)
+	e.uint32(uint32(len(entry.Addrs)))
+	for _, addr := range entry.Addrs {
+		e.string(addr)
+	}
+	return e.buf.Bytes()
+}
+
+// decodeAddrEntry decodes encodeAddrEntry
+func decodeAddrEntry(data []byte) (AddrEntry, error) {
+	d := &decoder{data: data}
+	d.version()
+	entry := AddrEntry{LastSeen: d.time()}
+	if n := d.count(minEncodedString); n > 0 {
+		entry.Addrs = make([]string, n)
+		for i := range entry.Addrs {
+			entry.Addrs[i] = d.string()
+		}
+	}
+	if err := d.finish(); err != nil {
+		return AddrEntry{}, fmt.Errorf("failed to decode address book entry: %w", err)
+	}
+	return entry, nil
+}
+
+func encodeBlockHeader(e *encoder, header BlockHeader) {
+	e.uint8(encodingVersion)
+	e.int64(int64(header.Index))
+	e.int64(header.Timestamp)
+	e.string(header.PrevHash)
+	e.bytes(header.MerkleRoot)
+	e.uint32(header.Bits)
+	e.int64(int64(header.Nonce))
+}
+
+func decodeBlockHeader(d *decoder) BlockHeader {
+	d.version()
+	return BlockHeader{
+		Index:      int(d.int64()),
+		Timestamp:  d.int64(),
+		PrevHash:   d.string(),
+		MerkleRoot: d.bytes(),
+		Bits:       d.uint32(),
+		Nonce:      int(d.int64()),
+	}
+}
+
+// encodeTransaction writes tx. The signing form leaves out the TxID and the
+// signature, which are derived from it.
+func encodeTransaction(e *encoder, tx Transaction, forSigning bool) {
+	e.uint8(encodingVersion)
+	if !forSigning {
+		e.string(tx.TxID)
+	}
+	e.bytes(tx.SenderPublicKey)
+	e.string(tx.SenderAddress)
+
+	e.uint32(uint32(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		e.string(in.TxID)
+		e.int64(int64(in.Index))
+	}
+	e.uint32(uint32(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		e.string(out.Address)
+		e.int64(int64(out.Amount))
+	}
+
+	e.time(tx.Timestamp)
+	if !forSigning {
+		e.bytes(tx.Signature)
+	}
+	e.int64(int64(tx.Fee))
+}
+
+func decodeTransaction(d *decoder) Transaction {
+	d.version()
+	tx := Transaction{
+		TxID:            d.string(),
+		SenderPublicKey: d.bytes(),
+		SenderAddress:   d.string(),
+	}
+
+	if n := d.count(minEncodedInput); n > 0 {
+		tx.Inputs = make([]TxInput, n)
+		for i := range tx.Inputs {
+			tx.Inputs[i] = TxInput{TxID: d.string(), Index: int(d.int64())}
+		}
+	}
+	if n := d.count(minEncodedOutput); n > 0 {
+		tx.Outputs = make([]TxOutput, n)
+		for i := range tx.Outputs {
+			tx.Outputs[i] = TxOutput{Address: d.string(), Amount: Amount(d.int64())}
+		}
+	}
+
+	tx.Timestamp = d.time()
+	tx.Signature = d.bytes()
+	tx.Fee = Amount(d.int64())
+	return tx
+}
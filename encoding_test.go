@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodingRoundTrip(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	useFundedNetwork(t, wallet, Coins(50))
+
+	genesis := CreateGenesisBlock()
+	utxos := []UTXO{{TxID: genesis.Transactions[0].TxID, Amount: Coins(50), Address: wallet.GetAddress()}}
+	tx, err := wallet.CreateTransaction(utxos, newTestAddress(t), Coins(25)/2, BaseUnitsPerCoin/4)
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	if err := wallet.SignTransaction(&tx); err != nil {
+		t.Fatalf("Failed to sign transaction: %v", err)
+	}
+	block := GenerateBlock(genesis, []Transaction{tx}, wallet.GetAddress(), CalcNextBits([]Block{genesis}))
+
+	decodedTx, err := DecodeTransaction(EncodeTransaction(tx))
+	if err != nil {
+		t.Fatalf("DecodeTransaction() error = %v", err)
+	}
+	if !bytes.Equal(EncodeTransaction(decodedTx), EncodeTransaction(tx)) || !decodedTx.Timestamp.Equal(tx.Timestamp) {
+		t.Error("Transaction did not survive a round trip")
+	}
+	if CalculateTxID(decodedTx) != tx.TxID || !ValidateTransaction(decodedTx, decodedTx.SenderPublicKey) {
+		t.Error("Decoded transaction no longer matches its TxID and signature")
+	}
+
+	decoded, err := DecodeBlock(EncodeBlock(block))
+	if err != nil {
+		t.Fatalf("DecodeBlock() error = %v", err)
+	}
+	if !bytes.Equal(EncodeBlock(decoded), EncodeBlock(block)) || CalculateBlockHash(decoded) != block.Hash {
+		t.Error("Block did not survive a round trip")
+	}
+
+	header, err := DecodeBlockHeader(EncodeBlockHeader(block.BlockHeader))
+	if err != nil {
+		t.Fatalf("DecodeBlockHeader() error = %v", err)
+	}
+	if !reflect.DeepEqual(header, block.BlockHeader) || header.BlockHash() != block.Hash {
+		t.Errorf("DecodeBlockHeader() = %+v, want %+v", header, block.BlockHeader)
+	}
+
+	// Malformed encodings are rejected
+	encoded := EncodeBlock(block)
+	if _, err := DecodeBlock(encoded[:len(encoded)-1]); !errors.Is(err, ErrTruncatedEncoding) {
+		t.Errorf("DecodeBlock() of a truncated block error = %v, want %v", err, ErrTruncatedEncoding)
+	}
+	if _, err := DecodeBlock(append(encoded, 0)); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("DecodeBlock() with trailing bytes error = %v, want %v", err, ErrTrailingBytes)
+	}
+	// A count needs room for the smallest encoding of each element, not
+	// just a byte each
+	padded := EncodeBlock(Block{BlockHeader: block.BlockHeader, Hash: block.Hash})
+	binary.BigEndian.PutUint32(padded[len(padded)-4:], 100)
+	if _, err := DecodeBlock(append(padded, make([]byte, 100)...)); !errors.Is(err, ErrTruncatedEncoding) {
+		t.Errorf("DecodeBlock() with an inflated transaction count error = %v, want %v", err, ErrTruncatedEncoding)
+	}
+	encoded[0] = encodingVersion + 1
+	if _, err := DecodeBlock(encoded); !errors.Is(err, ErrUnknownEncodingVersion) {
+		t.Errorf("DecodeBlock() of a future version error = %v, want %v", err, ErrUnknownEncodingVersion)
+	}
+}
+
+func TestEncodingIsUnambiguous(t *testing.T) {
+	// Fields that used to concatenate to the same preimage
+	a := BlockHeader{Index: 1, Timestamp: 23}
+	b := BlockHeader{Index: 12, Timestamp: 3}
+	if a.BlockHash() == b.BlockHash() {
+		t.Error("Different headers share a block hash")
+	}
+
+	ts := time.Unix(1234567890, 0)
+	x := Transaction{SenderAddress: "ab", Inputs: []TxInput{{TxID: "c", Index: 1}}, Timestamp: ts}
+	y := Transaction{SenderAddress: "a", Inputs: []TxInput{{TxID: "bc", Index: 1}}, Timestamp: ts}
+	if CalculateTxID(x) == CalculateTxID(y) {
+		t.Error("Different transactions share a TxID")
+	}
+
+	// Amounts are encoded exactly, not through decimal formatting
+	one := Transaction{Outputs: []TxOutput{{Address: "a", Amount: 1}}, Timestamp: ts}
+	two := Transaction{Outputs: []TxOutput{{Address: "a", Amount: 2}}, Timestamp: ts}
+	if CalculateTxID(one) == CalculateTxID(two) {
+		t.Error("Amounts one base unit apart share a TxID")
+	}
+}
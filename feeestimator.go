@@ -0,0 +1,188 @@
+package main
+
+import (
+	"sync"
+)
+
+// Fee estimation: the estimator records the fee rate of every transaction
+// entering the mempool and the height at which it did. When a block confirms
+// it, the number of blocks it waited is counted in the fee rate bucket of the
+// transaction. An estimate for a target of N blocks is the lowest bucket from
+// which, together with all higher ones, most transactions confirmed within N
+// blocks. The mempool adds its own view: a transaction must pay enough to be
+// among the pending bytes that N blocks can take.
+
+const (
+	maxConfirmTarget     = 48   // Highest target an estimate can be asked for
+	defaultConfirmTarget = 6    // Target used when the caller gives none
+	feeEstimatorDecay    = 0.99 // Weight left to past data with every block
+	minEstimateSamples   = 4.0  // Decayed transactions a bucket group needs
+	estimateSuccessRatio = 0.85 // Share of a group that must confirm in time
+
+	// Fee rate buckets grow by feeBucketSpacing from the lowest up to
+	// maxBucketFeeRate; the last bucket takes everything above
+	feeBucketSpacing = 1.25
+	maxBucketFeeRate = FeeRate(BaseUnitsPerCoin)
+)
+
+// FeeEstimate is a fee rate expected to confirm within Target blocks
+type FeeEstimate struct {
+	Target  int     `json:"target"`
+	FeeRate FeeRate `json:"feeRate"` // Coins per 1000 bytes
+	Source  string  `json:"source"`  // "history", or "mempool" before enough blocks were seen
+}
+
+// feeBucket counts the transactions paying at least rate, and less than the
+// next bucket's rate
+type feeBucket struct {
+	rate      FeeRate
+	confirmed [maxConfirmTarget + 1]float64 // [n]: confirmed within n blocks
+	total     float64                       // Confirmed at any time, or never within maxConfirmTarget
+}
+
+// trackedTx is a pending transaction the estimator waits to see confirmed
+type trackedTx struct {
+	bucket int
+	height int // Chain height when it entered the mempool
+}
+
+// FeeEstimator estimates fee rates from how long recent transactions took
+// to confirm and from the current mempool
+type FeeEstimator struct {
+	mempool *Mempool
+	buckets []feeBucket
+	tracked map[string]trackedTx
+	mutex   sync.Mutex
+
+	// isPending reports whether a tracked transaction is still in the
+	// mempool; transactions that left it unconfirmed are forgotten
+	isPending func(txID string) bool
+}
+
+func NewFeeEstimator(mempool *Mempool) *FeeEstimator {
+	e := &FeeEstimator{
+		mempool: mempool,
+		tracked: make(map[string]trackedTx),
+		isPending: func(txID string) bool {
+			_, ok := mempool.GetTransaction(txID)
+			return ok
+		},
+	}
+	for rate := float64(mempoolFeeIncrement); rate < float64(maxBucketFeeRate); rate *= feeBucketSpacing {
+		e.buckets = append(e.buckets, feeBucket{rate: FeeRate(rate)})
+	}
+	e.buckets = append(e.buckets, feeBucket{rate: maxBucketFeeRate})
+	return e
+}
+
+// bucketFor returns the index of the bucket of a fee rate
+func (e *FeeEstimator) bucketFor(rate FeeRate) int {
+	for i := len(e.buckets) - 1; i > 0; i-- {
+		if rate >= e.buckets[i].rate {
+			return i
+		}
+	}
+	return 0
+}
+
+// TxAdded starts tracking a transaction that entered the mempool while the
+// chain was at height
+func (e *FeeEstimator) TxAdded(tx Transaction, height int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, ok := e.tracked[tx.TxID]; ok {
+		return
+	}
+	rate := NewFeeRate(tx.Fee, len(EncodeTransaction(tx)))
+	e.tracked[tx.TxID] = trackedTx{bucket: e.bucketFor(rate), height: height}
+}
+
+// BlockConnected records how long the tracked transactions of a new
+// main-chain block waited. Older data loses weight, transactions that left
+// the mempool unconfirmed are forgotten, and those waiting longer than
+// maxConfirmTarget blocks count as not confirming.
+func (e *FeeEstimator) BlockConnected(block Block) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for i := range e.buckets {
+		b := &e.buckets[i]
+		for n := range b.confirmed {
+			b.confirmed[n] *= feeEstimatorDecay
+		}
+		b.total *= feeEstimatorDecay
+	}
+
+	for _, tx := range block.Transactions {
+		t, ok := e.tracked[tx.TxID]
+		if !ok {
+			continue
+		}
+		delete(e.tracked, tx.TxID)
+		b := &e.buckets[t.bucket]
+		for n := max(block.Index-t.height, 1); n <= maxConfirmTarget; n++ {
+			b.confirmed[n]++
+		}
+		b.total++
+	}
+
+	for txID, t := range e.tracked {
+		switch {
+		case !e.isPending(txID):
+			delete(e.tracked, txID)
+		case block.Index-t.height > maxConfirmTarget:
+			delete(e.tracked, txID)
+			e.buckets[t.bucket].total++
+		}
+	}
+}
+
+// Estimate returns the fee rate for confirmation within target blocks,
+// which must be between 1 and maxConfirmTarget. It is never below what the
+// mempool currently accepts.
+func (e *FeeEstimator) Estimate(target int, height int) FeeEstimate {
+	estimate := FeeEstimate{Target: target, Source: "mempool"}
+	if rate, ok := e.historyEstimate(target, height); ok {
+		estimate.FeeRate = rate
+		estimate.Source = "history"
+	}
+
+	// Everything paying more has to fit into the next target blocks first
+	depth := target * (MaxBlockSize - blockTemplateReserve)
+	estimate.FeeRate = max(estimate.FeeRate, e.mempool.FeeRateAtDepth(depth), e.mempool.MinFee())
+	return estimate
+}
+
+// historyEstimate walks the buckets from the highest fee rate down, grouping
+// buckets until a group has enough samples, and returns the lowest rate of
+// the last group in a row whose transactions mostly confirmed within target
+// blocks. Pending transactions that already waited longer count as failures.
+func (e *FeeEstimator) historyEstimate(target int, height int) (FeeRate, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	overdue := make([]float64, len(e.buckets))
+	for _, t := range e.tracked {
+		if height-t.height >= target {
+			overdue[t.bucket]++
+		}
+	}
+
+	var best FeeRate
+	found := false
+	var confirmed, total float64
+	for i := len(e.buckets) - 1; i >= 0; i-- {
+		confirmed += e.buckets[i].confirmed[target]
+		total += e.buckets[i].total + overdue[i]
+		if total < minEstimateSamples {
+			continue
+		}
+		if confirmed/total < estimateSuccessRatio {
+			break
+		}
+		best, found = e.buckets[i].rate, true
+		confirmed, total = 0, 0
+	}
+	return best, found
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFeeEstimates(t *testing.T) {
+	estimator := NewFeeEstimator(NewMempool(NewUTXOSet()))
+	estimator.isPending = func(string) bool { return true }
+
+	if estimate := estimator.Estimate(1, 0); estimate.Source != "mempool" || estimate.FeeRate != DefaultMinRelayFee {
+		t.Errorf("Estimate() without history = %+v, want the minimum relay fee", estimate)
+	}
+
+	// Every block confirms the high-fee transaction sent just before it and
+	// the low-fee one sent ten blocks earlier
+	newTx := func(id string, fee Amount) Transaction {
+		return Transaction{TxID: id, Fee: fee, Outputs: []TxOutput{{Address: "receiver", Amount: Coins(1)}}}
+	}
+	high, low := Amount(50000), Amount(500)
+	for height := 1; height <= 30; height++ {
+		estimator.TxAdded(newTx(fmt.Sprintf("high-%d", height), high), height-1)
+		estimator.TxAdded(newTx(fmt.Sprintf("low-%d", height), low), height-1)
+		block := Block{BlockHeader: BlockHeader{Index: height}}
+		block.Transactions = append(block.Transactions, newTx(fmt.Sprintf("high-%d", height), high))
+		if height > 10 {
+			block.Transactions = append(block.Transactions, newTx(fmt.Sprintf("low-%d", height-10), low))
+		}
+		estimator.BlockConnected(block)
+	}
+
+	size := len(EncodeTransaction(newTx("high-1", high)))
+	highRate, lowRate := NewFeeRate(high, size), NewFeeRate(low, size)
+	fast, slow := estimator.Estimate(1, 30), estimator.Estimate(20, 30)
+	if fast.Source != "history" || fast.FeeRate <= lowRate || fast.FeeRate > highRate {
+		t.Errorf("Estimate(1) = %+v, want the bucket of %s", fast, highRate)
+	}
+	if slow.Source != "history" || slow.FeeRate > lowRate {
+		t.Errorf("Estimate(20) = %+v, want at most %s", slow, lowRate)
+	}
+}
+
+func TestCreateTransactionAtRate(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	state := newFundedState(t, wallet, 2)
+
+	rate := FeeRate(50000)
+	utxos := state.GetUTXOSet().FindByAddress(wallet.GetAddress())
+	tx, err := wallet.CreateTransactionAtRate(utxos, newTestAddress(t), Coins(15), rate)
+	if err != nil {
+		t.Fatalf("CreateTransactionAtRate() error = %v", err)
+	}
+	if err := wallet.SignTransaction(&tx); err != nil {
+		t.Fatalf("Failed to sign transaction: %v", err)
+	}
+	if got := NewFeeRate(tx.Fee, len(EncodeTransaction(tx))); got < rate || len(tx.Inputs) != 2 {
+		t.Errorf("Transaction pays %s with %d inputs, want at least %s with 2", got, len(tx.Inputs), rate)
+	}
+	if err := state.AddTransaction(tx); err != nil {
+		t.Errorf("AddTransaction() error = %v", err)
+	}
+}
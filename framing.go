@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Every message on a P2P stream travels in one frame: the message type byte,
+// the payload length as a big-endian uint32, then the payload. Each message
+// type has a maximum payload size that is checked before the payload is
+// read, so a peer cannot make us buffer more than the largest message of
+// that type could legitimately be. Element counts inside the payload are
+// checked against its length before anything is allocated for them, see
+// decoder.count.
+
+const (
+	frameHeaderSize     = 5
+	frameTimeout        = 30 * time.Second // Read or write deadline per frame
+	maxChainMessageSize = 32 << 20         // Bytes of blocks in one chain reply
+)
+
+// Framing errors
+var (
+	ErrFrameTooLarge      = errors.New("frame exceeds the maximum size for its type")
+	ErrUnknownMessageType = errors.New("unknown message type")
+)
+
+// maxFrameSize is the largest payload accepted for each message type
+var maxFrameSize = map[MessageType]int{
+	MsgVersion:    4 << 10,
+	MsgGetBlock:   1 << 10,
+	MsgBlock:      MaxBlockSize,
+	MsgNotFound:   1 << 10,
+	MsgGetHeaders: 64 << 10,
+	MsgHeaders:    maxHeadersPerMessage * 512,
+	MsgTx:         MaxBlockSize,
+	MsgGetChain:   64,
+	MsgChain:      maxChainMessageSize,
+	MsgGetBlocks:  64 << 10,
+	MsgInv:        64 << 10,
+	MsgGetData:    64 << 10,
+}
+
+// WriteFrame writes msg as one frame
+func WriteFrame(w io.Writer, msg Message) error {
+	limit, ok := maxFrameSize[msg.Type]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownMessageType, msg.Type)
+	}
+	if len(msg.Payload) > limit {
+		return fmt.Errorf("%w: %s of %d bytes, limit %d", ErrFrameTooLarge, msg.Type, len(msg.Payload), limit)
+	}
+
+	frame := make([]byte, frameHeaderSize+len(msg.Payload))
+	frame[0] = byte(msg.Type)
+	binary.BigEndian.PutUint32(frame[1:frameHeaderSize], uint32(len(msg.Payload)))
+	copy(frame[frameHeaderSize:], msg.Payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads one frame. It returns io.EOF if the stream ends cleanly
+// before a frame starts. Errors of the reader, such as deadlines and reset
+// streams, are returned as they are; only a bad type or length is a framing
+// error.
+func ReadFrame(r io.Reader) (Message, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Message{}, err
+	}
+
+	msgType := MessageType(header[0])
+	limit, ok := maxFrameSize[msgType]
+	if !ok {
+		return Message{}, fmt.Errorf("%w: %d", ErrUnknownMessageType, header[0])
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if int64(size) > int64(limit) {
+		return Message{}, fmt.Errorf("%w: %s of %d bytes, limit %d", ErrFrameTooLarge, msgType, size, limit)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Message{}, fmt.Errorf("failed to read %s payload: %w", msgType, err)
+	}
+	return Message{Type: msgType, Payload: payload}, nil
+}
+
+// writeMessage writes one frame to a stream within frameTimeout
+func writeMessage(s network.Stream, msg Message) error {
+	s.SetWriteDeadline(time.Now().Add(frameTimeout))
+	return WriteFrame(s, msg)
+}
+
+// readMessage reads one frame from a stream within frameTimeout
+func readMessage(s network.Stream) (Message, error) {
+	s.SetReadDeadline(time.Now().Add(frameTimeout))
+	return ReadFrame(s)
+}
+
+// openStream opens a new stream of proto to a peer and sends msg on it. The
+// caller must close the stream.
+func openStream(h host.Host, to peer.ID, proto protocol.ID, msg Message) (network.Stream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), frameTimeout)
+	defer cancel()
+
+	s, err := h.NewStream(ctx, to, proto)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeMessage(s, msg); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return s, nil
+}
+
+// request sends msg to a peer on a new stream of proto and reads one reply
+func request(h host.Host, to peer.ID, proto protocol.ID, msg Message) (Message, error) {
+	s, err := openStream(h, to, proto, msg)
+	if err != nil {
+		return Message{}, err
+	}
+	defer s.Close()
+	return readMessage(s)
+}
+
+// send sends msg to a peer on a new stream of proto without waiting for a
+// reply
+func send(h host.Host, to peer.ID, proto protocol.ID, msg Message) error {
+	s, err := openStream(h, to, proto, msg)
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	hs := Handshake{Version: ProtocolVersion, ChainID: "devnet", GenesisHash: "00ff", BestHeight: 7, ChainWork: "1a", Features: []string{FeatureHeaders}}
+	messages := []Message{
+		{Type: MsgVersion, Payload: EncodeHandshake(hs)},
+		{Type: MsgGetHeaders, Payload: encodeHashes([]string{"a", "b"})},
+		{Type: MsgGetChain, Payload: encodeChainRange(ChainRange{Start: 3, End: 9})},
+		{Type: MsgNotFound, Payload: []byte{}},
+		{Type: MsgGetBlocks, Payload: encodeGetBlocks(GetBlocks{Locator: []string{"c", "d"}, Stop: "e"})},
+	}
+
+	var buf bytes.Buffer
+	for _, msg := range messages {
+		if err := WriteFrame(&buf, msg); err != nil {
+			t.Fatalf("WriteFrame(%s) error = %v", msg.Type, err)
+		}
+	}
+	for _, want := range messages {
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("ReadFrame() error = %v", err)
+		}
+		if got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("ReadFrame() = %s %x, want %s %x", got.Type, got.Payload, want.Type, want.Payload)
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Errorf("ReadFrame() at the end of the stream error = %v, want %v", err, io.EOF)
+	}
+
+	decoded, err := DecodeHandshake(messages[0].Payload)
+	if err != nil || !reflect.DeepEqual(decoded, hs) {
+		t.Errorf("DecodeHandshake() = %+v, %v, want %+v", decoded, err, hs)
+	}
+	r, err := decodeChainRange(messages[2].Payload)
+	if err != nil || r != (ChainRange{Start: 3, End: 9}) {
+		t.Errorf("decodeChainRange() = %+v, %v", r, err)
+	}
+	getBlocks, err := decodeGetBlocks(messages[4].Payload)
+	if err != nil || !reflect.DeepEqual(getBlocks, GetBlocks{Locator: []string{"c", "d"}, Stop: "e"}) {
+		t.Errorf("decodeGetBlocks() = %+v, %v", getBlocks, err)
+	}
+}
+
+func TestFrameLimits(t *testing.T) {
+	var buf bytes.Buffer
+	oversized := Message{Type: MsgGetChain, Payload: make([]byte, maxFrameSize[MsgGetChain]+1)}
+	if err := WriteFrame(&buf, oversized); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("WriteFrame() of an oversized payload error = %v, want %v", err, ErrFrameTooLarge)
+	}
+
+	// The declared length is rejected before the payload is read
+	header := make([]byte, frameHeaderSize)
+	header[0] = byte(MsgGetBlock)
+	binary.BigEndian.PutUint32(header[1:], 1<<31)
+	if _, err := ReadFrame(bytes.NewReader(header)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("ReadFrame() of an oversized frame error = %v, want %v", err, ErrFrameTooLarge)
+	}
+
+	header[0] = 0xff
+	if _, err := ReadFrame(bytes.NewReader(header)); !errors.Is(err, ErrUnknownMessageType) {
+		t.Errorf("ReadFrame() of an unknown type error = %v, want %v", err, ErrUnknownMessageType)
+	}
+
+	buf.Reset()
+	if err := WriteFrame(&buf, Message{Type: MsgGetBlock, Payload: []byte("abcd")}); err != nil {
+		t.Fatalf("WriteFrame() error = %v", err)
+	}
+	truncated := buf.Bytes()[:buf.Len()-1]
+	if _, err := ReadFrame(bytes.NewReader(truncated)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ReadFrame() of a truncated frame error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := ReadFrame(bytes.NewReader(truncated[:2])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ReadFrame() of a truncated header error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// Only bad type and length bytes are penalized, not streams that stall
+	// or end early
+	_, timeout := ReadFrame(iotest.ErrReader(os.ErrDeadlineExceeded))
+	for _, tt := range []struct {
+		err  error
+		want int
+	}{
+		{timeout, 0},
+		{fmt.Errorf("failed to read block payload: %w", io.ErrUnexpectedEOF), 0},
+		{fmt.Errorf("%w: 255", ErrUnknownMessageType), PenaltyMalformedMessage},
+		{fmt.Errorf("%w: getchain of 65 bytes", ErrFrameTooLarge), PenaltyOversizedMessage},
+	} {
+		if got := framePenalty(tt.err); got != tt.want {
+			t.Errorf("framePenalty(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFrameCountsDoNotAllocate(t *testing.T) {
+	// A chain reply of 1 MiB claiming a block for every byte
+	payload := make([]byte, 4+1<<20)
+	binary.BigEndian.PutUint32(payload, 1<<20)
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, Message{Type: MsgChain, Payload: payload}); err != nil {
+		t.Fatalf("WriteFrame() error = %v", err)
+	}
+	msg, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrame() error = %v", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = decodeChain(msg.Payload)
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, ErrTruncatedEncoding) {
+		t.Errorf("decodeChain() with an inflated count error = %v, want %v", err, ErrTruncatedEncoding)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("decodeChain() with an inflated count allocated %d bytes, want at most %d", allocated, 1<<20)
+	}
+}
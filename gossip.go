@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// New blocks and transactions are gossiped one at a time: a block is
+// announced on BlockProtocol, a transaction on TxProtocol. A node that
+// accepts an announced item relays it to its other peers. Every accepted item
+// is remembered by hash, so it is relayed at most once however many peers
+// announce it. An item whose claimed hash does not match its contents is
+// dropped before it can be remembered, so it cannot shadow the real one.
+
+const (
+	maxSeenItems        = 10000 // Hashes remembered per kind of item
+	maxBlocksPerMessage = 500   // Blocks sent in reply to one getchain
+)
+
+// ChainRange asks for the main-chain blocks from Start to End, inclusive
+type ChainRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// hashFilter remembers the most recent hashes seen, up to a fixed number
+type hashFilter struct {
+	seen  map[string]struct{}
+	order []string
+	max   int
+	mutex sync.Mutex
+}
+
+func newHashFilter(max int) *hashFilter {
+	return &hashFilter{
+		seen: make(map[string]struct{}),
+		max:  max,
+	}
+}
+
+// Has reports whether hash is remembered
+func (f *hashFilter) Has(hash string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	_, ok := f.seen[hash]
+	return ok
+}
+
+// Add records hash and reports whether it was new. Once full, the oldest
+// hash is forgotten.
+func (f *hashFilter) Add(hash string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, ok := f.seen[hash]; ok {
+		return false
+	}
+	if len(f.order) >= f.max {
+		delete(f.seen, f.order[0])
+		f.order = f.order[1:]
+	}
+	f.seen[hash] = struct{}{}
+	f.order = append(f.order, hash)
+	return true
+}
+
+// SetupGossipHandlers registers the transaction relay handler on TxProtocol
+// and serves chain ranges on ChainProtocol. Block announcements arrive on
+// BlockProtocol, see SetupBlockHandler.
+func SetupGossipHandlers(h host.Host, state *BlockchainState) {
+	h.SetStreamHandler(TxProtocol, func(s network.Stream) {
+		defer s.Close()
+		from := s.Conn().RemotePeer()
+
+		msg, err := readMessage(s)
+		if err != nil {
+			fmt.Printf("❌ Bad transaction message from %s: %v\n", from, err)
+			penalizePeer(h, state, from, framePenalty(err), "bad frame")
+			s.Reset()
+			return
+		}
+		if msg.Type != MsgTx {
+			penalizePeer(h, state, from, PenaltyUnsolicited, "unexpected "+msg.Type.String())
+			s.Reset()
+			return
+		}
+		tx, err := DecodeTransaction(msg.Payload)
+		if err != nil {
+			fmt.Printf("❌ Bad transaction from %s: %v\n", from, err)
+			penalizePeer(h, state, from, PenaltyMalformedMessage, "undecodable transaction")
+			return
+		}
+		handleTransactionAnnouncement(h, state, tx, from)
+	})
+
+	h.SetStreamHandler(ChainProtocol, func(s network.Stream) {
+		defer s.Close()
+		from := s.Conn().RemotePeer()
+
+		msg, err := readMessage(s)
+		if err != nil {
+			fmt.Printf("❌ Bad chain request from %s: %v\n", from, err)
+			penalizePeer(h, state, from, framePenalty(err), "bad frame")
+			s.Reset()
+			return
+		}
+
+		switch msg.Type {
+		case MsgGetChain:
+			err = serveChainRange(s, state, msg.Payload)
+		case MsgGetBlocks:
+			err = serveInventory(s, state, msg.Payload)
+		case MsgGetData:
+			err = serveData(s, state, msg.Payload)
+		default:
+			penalizePeer(h, state, from, PenaltyUnsolicited, "unexpected "+msg.Type.String())
+			s.Reset()
+			return
+		}
+		if errors.Is(err, ErrMalformedRequest) {
+			fmt.Printf("❌ Bad %s request from %s: %v\n", msg.Type, from, err)
+			penalizePeer(h, state, from, PenaltyMalformedMessage, "undecodable "+msg.Type.String())
+			s.Reset()
+		} else if err != nil {
+			fmt.Printf("❌ Error answering %s from %s: %v\n", msg.Type, from, err)
+		}
+	})
+}
+
+// serveChainRange answers a getchain request with as many of the requested
+// blocks as fit in one frame
+func serveChainRange(s network.Stream, state *BlockchainState, payload []byte) error {
+	r, err := decodeChainRange(payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedRequest, err)
+	}
+
+	blocks := state.GetChainRange(r.Start, r.End, maxBlocksPerMessage)
+	size := 0
+	for i, block := range blocks {
+		if size += blockSize(block) + 4; size > maxChainMessageSize-4 {
+			blocks = blocks[:i]
+			break
+		}
+	}
+	return writeMessage(s, Message{Type: MsgChain, Payload: encodeChain(blocks)})
+}
+
+// fromHandshakenPeer reports whether the sender of a gossiped item completed
+// the handshake. Items from other peers are dropped and the sender is
+// penalized, so they cannot fill the orphan pool or the mempool.
+func fromHandshakenPeer(h host.Host, state *BlockchainState, from peer.ID, item string) bool {
+	if _, ok := state.GetPeers().Get(from); ok {
+		return true
+	}
+	fmt.Printf("❌ Dropped %s from %s: no handshake\n", item, from)
+	penalizePeer(h, state, from, PenaltyUnsolicited, item+" before handshake")
+	return false
+}
+
+// handleBlockAnnouncement adds a block announced by a peer and relays it to
+// our other peers if it was accepted
+func handleBlockAnnouncement(h host.Host, state *BlockchainState, block Block, from peer.ID) {
+	if !fromHandshakenPeer(h, state, from, "block") || state.seenBlocks.Has(block.Hash) {
+		return
+	}
+	if hash := CalculateBlockHash(block); hash != block.Hash {
+		fmt.Printf("❌ Rejected block %s from %s: hash does not match contents (%s)\n", block.Hash, from, hash)
+		penalizePeer(h, state, from, PenaltyInvalidBlock, "block hash mismatch")
+		return
+	}
+
+	fmt.Printf("📦 Block %d (%s) announced by %s\n", block.Index, block.Hash, from)
+	if err := state.AddBlockFromPeer(block, from); err != nil {
+		if !errors.Is(err, ErrOrphanBlock) && !errors.Is(err, ErrDuplicateBlock) {
+			fmt.Printf("❌ Rejected block %s from %s: %v\n", block.Hash, from, err)
+			penalizePeer(h, state, from, PenaltyInvalidBlock, "invalid block")
+		}
+		return
+	}
+	AnnounceBlock(h, state, block, from)
+}
+
+// handleTransactionAnnouncement adds a transaction relayed by a peer to the
+// mempool and relays it on if it was accepted
+func handleTransactionAnnouncement(h host.Host, state *BlockchainState, tx Transaction, from peer.ID) {
+	if !fromHandshakenPeer(h, state, from, "transaction") || state.seenTxs.Has(tx.TxID) {
+		return
+	}
+	if id := CalculateTxID(tx); id != tx.TxID {
+		fmt.Printf("❌ Dropped transaction %s from %s: TxID does not match contents (%s)\n", tx.TxID, from, id)
+		penalizePeer(h, state, from, PenaltyMalformedMessage, "transaction ID mismatch")
+		return
+	}
+
+	if err := state.AddTransaction(tx); err != nil {
+		fmt.Printf("⚠️ Dropped transaction %s from %s: %v\n", tx.TxID, from, err)
+		if errors.Is(err, ErrInvalidSignature) {
+			penalizePeer(h, state, from, PenaltyBadSignature, "bad signature")
+		}
+		return
+	}
+	fmt.Printf("💸 Transaction %s relayed by %s\n", tx.TxID, from)
+	AnnounceTransaction(h, state, tx, from)
+}
+
+// AnnounceBlock sends a new block to every connected peer except the one it
+// came from, if any
+func AnnounceBlock(h host.Host, state *BlockchainState, block Block, except peer.ID) {
+	state.seenBlocks.Add(block.Hash)
+	broadcast(h, BlockProtocol, Message{Type: MsgBlock, Payload: EncodeBlock(block)}, except)
+}
+
+// AnnounceTransaction sends a new transaction to every connected peer except
+// the one it came from, if any
+func AnnounceTransaction(h host.Host, state *BlockchainState, tx Transaction, except peer.ID) {
+	state.seenTxs.Add(tx.TxID)
+	broadcast(h, TxProtocol, Message{Type: MsgTx, Payload: EncodeTransaction(tx)}, except)
+}
+
+// broadcast sends msg on proto to every connected peer but except, each
+// on its own stream and in the background
+func broadcast(h host.Host, proto protocol.ID, msg Message, except peer.ID) {
+	if h == nil {
+		return
+	}
+
+	for _, p := range h.Network().Peers() {
+		if p == except {
+			continue
+		}
+		go func(p peer.ID) {
+			if err := send(h, p, proto, msg); err != nil {
+				fmt.Printf("❌ Failed to send %s to %s: %v\n", msg.Type, p, err)
+			}
+		}(p)
+	}
+}
+
+// FetchChainRange downloads main-chain blocks by height from a peer. The
+// peer may return fewer blocks than asked for.
+func FetchChainRange(h host.Host, from peer.ID, start, end int) ([]Block, error) {
+	req := Message{Type: MsgGetChain, Payload: encodeChainRange(ChainRange{Start: start, End: end})}
+	reply, err := request(h, from, ChainProtocol, req)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != MsgChain {
+		return nil, fmt.Errorf("unexpected reply %s to getchain", reply.Type)
+	}
+
+	blocks, err := decodeChain(reply.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("bad chain reply: %w", err)
+	}
+	if len(blocks) > maxBlocksPerMessage {
+		return nil, fmt.Errorf("peer sent %d blocks, more than %d", len(blocks), maxBlocksPerMessage)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Peers open every connection with a handshake on protocolID: each side
+// sends a Handshake describing its software and chain, and disconnects a
+// peer that speaks an incompatible version or follows another network.
+
+const (
+	// ProtocolVersion is the version of the peer protocol this node speaks
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest peer version this node talks to
+	MinProtocolVersion = 1
+)
+
+// Features a node can advertise in its handshake
+const (
+	FeatureHeaders     = "headers"     // Serves getheaders, see SyncManager
+	FeatureGossip      = "gossip"      // Relays blocks and transactions
+	FeatureChainRanges = "chainranges" // Serves getchain on ChainProtocol
+	FeatureInventory   = "inventory"   // Serves getblocks and getdata on ChainProtocol
+)
+
+// Handshake errors
+var (
+	ErrIncompatibleVersion = errors.New("incompatible protocol version")
+	ErrWrongNetwork        = errors.New("peer is on a different network")
+)
+
+// Handshake is what a node tells a peer about itself when they connect
+type Handshake struct {
+	Version     int      `json:"version"`
+	ChainID     string   `json:"chainId"`
+	GenesisHash string   `json:"genesisHash"`
+	BestHeight  int      `json:"bestHeight"`
+	ChainWork   string   `json:"chainWork"` // Hex total work of the best chain
+	Features    []string `json:"features"`
+}
+
+// HasFeature reports whether the peer advertised feature
+func (hs Handshake) HasFeature(feature string) bool {
+	for _, f := range hs.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalHandshake describes this node and its current best chain
+func (s *BlockchainState) LocalHandshake() Handshake {
+	tip := s.GetLastBlock()
+	return Handshake{
+		Version:     ProtocolVersion,
+		ChainID:     activeParams.ChainID,
+		GenesisHash: activeParams.GenesisHash(),
+		BestHeight:  tip.Index,
+		ChainWork:   tip.ChainWork,
+		Features:    []string{FeatureHeaders, FeatureGossip, FeatureChainRanges, FeatureInventory},
+	}
+}
+
+// CheckHandshake checks that a peer's handshake is compatible with ours
+func CheckHandshake(local, remote Handshake) error {
+	if remote.Version < MinProtocolVersion {
+		return fmt.Errorf("%w: peer speaks %d, we need at least %d",
+			ErrIncompatibleVersion, remote.Version, MinProtocolVersion)
+	}
+	if remote.ChainID != local.ChainID || remote.GenesisHash != local.GenesisHash {
+		return fmt.Errorf("%w: chain %s with genesis %s", ErrWrongNetwork, remote.ChainID, remote.GenesisHash)
+	}
+	return nil
+}
+
+// PeerInfo is what we know about a connected peer from its handshake
+type PeerInfo struct {
+	Handshake
+	ConnectedAt time.Time
+}
+
+// PeerSet keeps the handshake of every connected peer
+type PeerSet struct {
+	peers map[peer.ID]PeerInfo
+	mutex sync.RWMutex
+}
+
+func NewPeerSet() *PeerSet {
+	return &PeerSet{
+		peers: make(map[peer.ID]PeerInfo),
+	}
+}
+
+// Add records the handshake of a peer, replacing an earlier one
+func (ps *PeerSet) Add(id peer.ID, hs Handshake) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.peers[id] = PeerInfo{Handshake: hs, ConnectedAt: time.Now()}
+}
+
+// Get returns the handshake info of a peer
+func (ps *PeerSet) Get(id peer.ID) (PeerInfo, bool) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	info, ok := ps.peers[id]
+	return info, ok
+}
+
+// All returns the handshake info of every peer
+func (ps *PeerSet) All() map[peer.ID]PeerInfo {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	peers := make(map[peer.ID]PeerInfo, len(ps.peers))
+	for id, info := range ps.peers {
+		peers[id] = info
+	}
+	return peers
+}
+
+// Best returns the peer supporting feature whose handshake claims the most
+// chain work
+func (ps *PeerSet) Best(feature string) (peer.ID, PeerInfo, bool) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	var bestID peer.ID
+	var best PeerInfo
+	var bestWork *big.Int
+	for id, info := range ps.peers {
+		if !info.HasFeature(feature) {
+			continue
+		}
+		work := ParseChainWork(info.ChainWork)
+		if bestWork == nil || work.Cmp(bestWork) > 0 || (work.Cmp(bestWork) == 0 && id < bestID) {
+			bestID, best, bestWork = id, info, work
+		}
+	}
+	return bestID, best, bestWork != nil
+}
+
+// Remove forgets a disconnected peer
+func (ps *PeerSet) Remove(id peer.ID) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	delete(ps.peers, id)
+}
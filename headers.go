@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+)
+
+// Headers-first sync: a node downloads the header chain of a peer and checks
+// its proof of work, difficulty, timestamps and total work before fetching
+// any block body. A fork that is invalid or carries less work is rejected
+// after a few kilobytes of headers.
+
+// maxHeadersPerMessage caps the headers sent in reply to one getheaders
+const maxHeadersPerMessage = 2000
+
+// BlockLocator returns hashes of main-chain blocks from the tip back to
+// genesis, one per block for the last ten blocks and then exponentially
+// sparser, so a peer can find the last block both chains share from a few
+// dozen hashes.
+func (s *BlockchainState) BlockLocator() []string {
+	s.chainMutex.RLock()
+	defer s.chainMutex.RUnlock()
+
+	var locator []string
+	step := 1
+	for height := len(s.chain) - 1; height > 0; height -= step {
+		locator = append(locator, s.chain[height].Hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	if len(s.chain) > 0 {
+		locator = append(locator, s.chain[0].Hash)
+	}
+	return locator
+}
+
+// HeadersAfter returns up to max main-chain headers following the first
+// locator hash on our main chain, or following genesis if none is
+func (s *BlockchainState) HeadersAfter(locator []string, max int) []BlockHeader {
+	s.chainMutex.RLock()
+	defer s.chainMutex.RUnlock()
+
+	var headers []BlockHeader
+	for height := s.locatorFork(locator) + 1; height < len(s.chain) && len(headers) < max; height++ {
+		headers = append(headers, s.chain[height].BlockHeader)
+	}
+	return headers
+}
+
+// BlocksAfter returns the hashes of up to max main-chain blocks following
+// the first locator hash on our main chain, or following genesis if none
+// is. The list ends early at stop if stop is one of them.
+func (s *BlockchainState) BlocksAfter(locator []string, stop string, max int) []string {
+	s.chainMutex.RLock()
+	defer s.chainMutex.RUnlock()
+
+	var hashes []string
+	for height := s.locatorFork(locator) + 1; height < len(s.chain) && len(hashes) < max; height++ {
+		hashes = append(hashes, s.chain[height].Hash)
+		if s.chain[height].Hash == stop {
+			break
+		}
+	}
+	return hashes
+}
+
+// locatorFork returns the height of the first locator hash on our main
+// chain, or 0 for genesis if none is. The caller must hold chainMutex.
+func (s *BlockchainState) locatorFork(locator []string) int {
+	for _, hash := range locator {
+		if node := s.index.Lookup(hash); node != nil && s.isOnMainChain(node) {
+			return node.height()
+		}
+	}
+	return 0
+}
+
+// ProcessHeaders validates a chain of headers received from a peer. The
+// first header must extend a block we know. It returns the headers whose
+// blocks we still need, in chain order, or nil if the header chain carries
+// no more work than our own.
+func (s *BlockchainState) ProcessHeaders(headers []BlockHeader) ([]BlockHeader, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+
+	s.chainMutex.RLock()
+	defer s.chainMutex.RUnlock()
+
+	parent := s.index.Lookup(headers[0].PrevHash)
+	if parent == nil {
+		return nil, fmt.Errorf("%w: header %d extends unknown block %s",
+			ErrBadPrevBlock, headers[0].Index, headers[0].PrevHash)
+	}
+
+	chain := headerTail(s.ancestry(parent))
+	work := new(big.Int).Set(parent.work)
+	for _, header := range headers {
+		if err := CheckHeaderSanity(header); err != nil {
+			return nil, fmt.Errorf("invalid header %d: %w", header.Index, err)
+		}
+		if err := CheckHeaderContext(header, chain); err != nil {
+			return nil, fmt.Errorf("invalid header %d: %w", header.Index, err)
+		}
+		chain = append(chain, header)
+		work.Add(work, CalcWork(header.Bits))
+	}
+
+	tip := &blockNode{block: Block{Hash: headers[len(headers)-1].BlockHash()}, work: work}
+	if !tip.isBetterThan(s.tipNode()) {
+		return nil, nil
+	}
+
+	var needed []BlockHeader
+	for _, header := range headers {
+		if s.index.Lookup(header.BlockHash()) == nil {
+			needed = append(needed, header)
+		}
+	}
+	return needed, nil
+}
+
+// CheckBlockBody checks that a downloaded block is the block of header and
+// that its transactions match the header's merkle root
+func CheckBlockBody(header BlockHeader, block Block) error {
+	if hash := header.BlockHash(); block.Hash != hash || CalculateBlockHash(block) != hash {
+		return fmt.Errorf("%w: got block %s, want %s", ErrBadBlockHash, block.Hash, hash)
+	}
+	root, err := GetMerkleRoot(block.Transactions)
+	if err != nil || !bytes.Equal(root, header.MerkleRoot) {
+		return ErrBadMerkleRoot
+	}
+	return nil
+}
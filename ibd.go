@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// The SyncManager brings the node up to the chain with the most work among
+// its peers. Each sync goes through two phases:
+//
+//   - headers: the peer whose handshake claims the most work is asked for
+//     its headers past our block locator, which finds the fork point. The
+//     headers are validated, and the sync stops if they carry no more work
+//     than our chain.
+//   - blocks: the missing bodies are split into windows of consecutive
+//     heights, which are fetched in parallel with getchain, one window per
+//     peer at a time, from every peer that serves chain ranges and is far
+//     enough ahead. Bodies are checked against the headers and connected in
+//     height order. A failed request is retried elsewhere, and the window
+//     holding the next block to connect is handed to an idle peer as well
+//     when it takes longer than the stall timeout. A peer failing too often
+//     is left out for the rest of the sync.
+//
+// A sync starts when a peer ahead of us connects, and periodically in case
+// an earlier sync failed.
+
+const (
+	ibdWindowSize        = 100              // Blocks per getchain request
+	ibdMaxBufferedBlocks = 1000             // Blocks downloaded ahead of the next to connect
+	ibdStallTimeout      = 10 * time.Second // After which the next window is reassigned
+	ibdMaxPeerFailures   = 3
+	ibdCheckInterval     = time.Minute
+)
+
+// SyncPhase is the phase of the SyncManager
+type SyncPhase string
+
+const (
+	SyncPhaseIdle    SyncPhase = "idle"
+	SyncPhaseHeaders SyncPhase = "headers"
+	SyncPhaseBlocks  SyncPhase = "blocks"
+)
+
+// ErrNoSyncPeers is returned when no peer is left to download from
+var ErrNoSyncPeers = errors.New("no peers left to sync from")
+
+// SyncProgress describes the current or last sync
+type SyncProgress struct {
+	Phase           SyncPhase      `json:"phase"`
+	Peer            string         `json:"peer,omitempty"` // Source of the headers
+	Height          int            `json:"height"`         // Our best height
+	TargetHeight    int            `json:"targetHeight"`
+	HeadersReceived int            `json:"headersReceived"`
+	BlocksNeeded    int            `json:"blocksNeeded"`
+	BlocksConnected int            `json:"blocksConnected"`
+	InFlight        int            `json:"inFlight"`     // Outstanding getchain requests
+	BlocksByPeer    map[string]int `json:"blocksByPeer"` // Bodies received per peer
+	StartedAt       time.Time      `json:"startedAt"`
+	FinishedAt      time.Time      `json:"finishedAt"`
+	LastError       string         `json:"lastError,omitempty"`
+}
+
+// SyncManager runs one sync at a time. It is safe for concurrent use.
+type SyncManager struct {
+	h     host.Host
+	state *BlockchainState
+
+	windowSize   int
+	stallTimeout time.Duration
+
+	trigger   chan struct{}
+	progress  SyncProgress
+	mutex     sync.Mutex // Guards progress
+	syncMutex sync.Mutex // Held for the duration of a sync
+}
+
+func NewSyncManager(h host.Host, state *BlockchainState) *SyncManager {
+	return &SyncManager{
+		h:            h,
+		state:        state,
+		windowSize:   ibdWindowSize,
+		stallTimeout: ibdStallTimeout,
+		trigger:      make(chan struct{}, 1),
+		progress:     SyncProgress{Phase: SyncPhaseIdle, BlocksByPeer: map[string]int{}},
+	}
+}
+
+// Run syncs whenever Trigger is called and every ibdCheckInterval, until
+// ctx is done
+func (sm *SyncManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(ibdCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := sm.Sync(); err != nil {
+			fmt.Printf("❌ Sync failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-sm.trigger:
+		}
+	}
+}
+
+// Trigger asks Run to sync as soon as the current sync, if any, ends
+func (sm *SyncManager) Trigger() {
+	select {
+	case sm.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Progress returns the progress of the current or last sync
+func (sm *SyncManager) Progress() SyncProgress {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	p := sm.progress
+	p.Height = sm.state.GetLastBlock().Index
+	p.BlocksByPeer = make(map[string]int, len(sm.progress.BlocksByPeer))
+	for id, n := range sm.progress.BlocksByPeer {
+		p.BlocksByPeer[id] = n
+	}
+	return p
+}
+
+// update changes the progress under the mutex
+func (sm *SyncManager) update(fn func(p *SyncProgress)) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	fn(&sm.progress)
+}
+
+// Sync syncs once from the peer with the most work, if it has more than us
+func (sm *SyncManager) Sync() error {
+	sm.syncMutex.Lock()
+	defer sm.syncMutex.Unlock()
+
+	best, info, ok := sm.state.GetPeers().Best(FeatureHeaders)
+	local := sm.state.LocalHandshake()
+	if !ok || ParseChainWork(info.ChainWork).Cmp(ParseChainWork(local.ChainWork)) <= 0 {
+		return nil
+	}
+
+	sm.mutex.Lock()
+	sm.progress = SyncProgress{
+		Phase:        SyncPhaseHeaders,
+		Peer:         best.String(),
+		TargetHeight: info.BestHeight,
+		BlocksByPeer: map[string]int{},
+		StartedAt:    time.Now(),
+	}
+	sm.mutex.Unlock()
+	fmt.Printf("🔄 Syncing from %s (height %d)\n", best, info.BestHeight)
+
+	err := sm.sync(best)
+	sm.update(func(p *SyncProgress) {
+		p.Phase = SyncPhaseIdle
+		p.InFlight = 0
+		p.FinishedAt = time.Now()
+		if err != nil {
+			p.LastError = err.Error()
+		}
+	})
+	return err
+}
+
+func (sm *SyncManager) sync(best peer.ID) error {
+	headers, err := downloadHeaders(sm.h, best, sm.state.BlockLocator(), func(n int) {
+		sm.update(func(p *SyncProgress) { p.HeadersReceived = n })
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch headers from %s: %w", best, err)
+	}
+
+	needed, err := sm.state.ProcessHeaders(headers)
+	if err != nil {
+		penalizePeer(sm.h, sm.state, best, PenaltyInvalidBlock, "invalid headers")
+		return fmt.Errorf("rejected headers from %s: %w", best, err)
+	}
+	if len(needed) == 0 {
+		fmt.Printf("✅ In sync with %s (%d headers checked)\n", best, len(headers))
+		return nil
+	}
+
+	sm.update(func(p *SyncProgress) {
+		p.Phase = SyncPhaseBlocks
+		p.BlocksNeeded = len(needed)
+		p.TargetHeight = needed[len(needed)-1].Index
+	})
+	fmt.Printf("📥 Downloading %d blocks\n", len(needed))
+	return sm.downloadBlocks(best, needed)
+}
+
+// downloadHeaders fetches a peer's headers past locator in batches. progress
+// is called with the number of headers received so far.
+func downloadHeaders(h host.Host, from peer.ID, locator []string, progress func(int)) ([]BlockHeader, error) {
+	var headers []BlockHeader
+	for {
+		batch, err := fetchHeaders(h, from, locator)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, batch...)
+		progress(len(headers))
+		if len(batch) < maxHeadersPerMessage {
+			return headers, nil
+		}
+		locator = []string{batch[len(batch)-1].BlockHash()}
+	}
+}
+
+// blockWindow is a range of heights fetched with one getchain request
+type blockWindow struct {
+	start, end int
+}
+
+// windowResult is the outcome of one getchain request
+type windowResult struct {
+	from   peer.ID
+	window blockWindow
+	blocks []Block
+	err    error
+}
+
+// flight is a request in progress
+type flight struct {
+	window blockWindow
+	since  time.Time
+	stale  bool // Reassigned to another peer
+}
+
+// downloadBlocks fetches the bodies of needed, which sit at consecutive
+// heights, and connects them in order. best is the source of the headers.
+func (sm *SyncManager) downloadBlocks(best peer.ID, needed []BlockHeader) error {
+	first, last := needed[0].Index, needed[len(needed)-1].Index
+	header := func(height int) BlockHeader { return needed[height-first] }
+
+	var queue []blockWindow
+	for start := first; start <= last; start += sm.windowSize {
+		queue = append(queue, blockWindow{start, min(start+sm.windowSize-1, last)})
+	}
+
+	inFlight := make(map[peer.ID]*flight)
+	failures := make(map[peer.ID]int)
+	excluded := make(map[peer.ID]bool)
+	received := make(map[int]Block)
+	sources := make(map[int]peer.ID)
+	next := first
+	results := make(chan windowResult)
+
+	// covered reports whether every block of a window was received
+	covered := func(w blockWindow) bool {
+		for height := max(w.start, next); height <= w.end; height++ {
+			if _, ok := received[height]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	requeue := func(w blockWindow) {
+		if w.start < next {
+			w.start = next
+		}
+		if w.start <= w.end && !covered(w) {
+			queue = append([]blockWindow{w}, queue...)
+		}
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer func() {
+		// Let requests still running finish without blocking
+		go func(n int) {
+			for ; n > 0; n-- {
+				<-results
+			}
+		}(len(inFlight))
+	}()
+
+	for next <= last {
+		// Hand out windows to every idle peer that has them
+		peers := sm.downloadPeers(best, last, excluded)
+		for _, id := range peers {
+			if _, busy := inFlight[id]; busy {
+				continue
+			}
+			w, ok := sm.nextWindow(&queue, next)
+			if !ok {
+				break
+			}
+			inFlight[id] = &flight{window: w, since: time.Now()}
+			go func(id peer.ID, w blockWindow) {
+				blocks, err := FetchChainRange(sm.h, id, w.start, w.end)
+				results <- windowResult{from: id, window: w, blocks: blocks, err: err}
+			}(id, w)
+		}
+		if len(inFlight) == 0 {
+			return ErrNoSyncPeers
+		}
+		sm.update(func(p *SyncProgress) { p.InFlight = len(inFlight) })
+
+		var r windowResult
+		select {
+		case r = <-results:
+		case <-ticker.C:
+			// Reassign the window blocking the chain if it takes too long
+			for id, f := range inFlight {
+				if !f.stale && f.window.start <= next && next <= f.window.end &&
+					time.Since(f.since) > sm.stallTimeout {
+					fmt.Printf("⏳ Peer %s stalled on blocks %d-%d, reassigning\n", id, f.window.start, f.window.end)
+					f.stale = true
+					requeue(f.window)
+				}
+			}
+			continue
+		}
+
+		f := inFlight[r.from]
+		delete(inFlight, r.from)
+		got, err := sm.checkWindow(r, header)
+		for _, block := range got {
+			if _, ok := received[block.Index]; !ok && block.Index >= next {
+				received[block.Index] = block
+				sources[block.Index] = r.from
+			}
+		}
+		sm.update(func(p *SyncProgress) { p.BlocksByPeer[r.from.String()] += len(got) })
+
+		if err != nil {
+			fmt.Printf("❌ Failed to fetch blocks %d-%d from %s: %v\n", r.window.start, r.window.end, r.from, err)
+			failures[r.from]++
+			if badBody := errors.Is(err, ErrBadBlockHash) || errors.Is(err, ErrBadMerkleRoot); badBody || failures[r.from] >= ibdMaxPeerFailures {
+				excluded[r.from] = true
+				// Only the source of the headers has no excuse for other bodies
+				if badBody && r.from == best {
+					penalizePeer(sm.h, sm.state, best, PenaltyInvalidBlock, "block does not match its header")
+				}
+			}
+		}
+		if !f.stale {
+			requeue(r.window)
+		}
+
+		// Connect every block we now have in order
+		for block, ok := received[next]; ok; block, ok = received[next] {
+			if err := sm.state.AddBlockFromPeer(block, sources[next]); err != nil && !errors.Is(err, ErrDuplicateBlock) {
+				penalizePeer(sm.h, sm.state, sources[next], PenaltyInvalidBlock, "invalid block")
+				return fmt.Errorf("rejected block %d from %s: %w", next, sources[next], err)
+			}
+			delete(received, next)
+			delete(sources, next)
+			next++
+			sm.update(func(p *SyncProgress) { p.BlocksConnected++ })
+		}
+	}
+	fmt.Printf("✅ Synced to height %d\n", last)
+	return nil
+}
+
+// nextWindow takes the first queued window that is not too far ahead of the
+// next block to connect
+func (sm *SyncManager) nextWindow(queue *[]blockWindow, next int) (blockWindow, bool) {
+	for len(*queue) > 0 {
+		w := (*queue)[0]
+		if w.start >= next+ibdMaxBufferedBlocks {
+			return blockWindow{}, false
+		}
+		*queue = (*queue)[1:]
+		if w.end < next {
+			continue
+		}
+		return w, true
+	}
+	return blockWindow{}, false
+}
+
+// downloadPeers returns the peers to fetch bodies from: best, and every
+// other peer serving chain ranges whose handshake reaches last. Peers are
+// ordered by ID so windows are handed out deterministically.
+func (sm *SyncManager) downloadPeers(best peer.ID, last int, excluded map[peer.ID]bool) []peer.ID {
+	var peers []peer.ID
+	for id, info := range sm.state.GetPeers().All() {
+		if excluded[id] || !info.HasFeature(FeatureChainRanges) {
+			continue
+		}
+		if id == best || info.BestHeight >= last {
+			peers = append(peers, id)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	return peers
+}
+
+// checkWindow returns the blocks of a getchain reply that match their
+// headers, and an error if the reply was short of the window or had a bad
+// block. Blocks must start at the window start and be consecutive.
+func (sm *SyncManager) checkWindow(r windowResult, header func(int) BlockHeader) ([]Block, error) {
+	if r.err != nil {
+		if penalty := framePenalty(r.err); penalty > 0 {
+			penalizePeer(sm.h, sm.state, r.from, penalty, "bad chain reply")
+		}
+		return nil, r.err
+	}
+	if len(r.blocks) == 0 {
+		return nil, errors.New("peer sent no blocks")
+	}
+
+	var got []Block
+	for i, block := range r.blocks {
+		height := r.window.start + i
+		if block.Index != height || height > r.window.end {
+			penalizePeer(sm.h, sm.state, r.from, PenaltyUnsolicited, "block out of range")
+			return got, fmt.Errorf("block %d out of range", block.Index)
+		}
+		// A peer on another branch serves other blocks at these heights,
+		// which is not misbehavior
+		if err := CheckBlockBody(header(height), block); err != nil {
+			return got, fmt.Errorf("block %d: %w", height, err)
+		}
+		got = append(got, block)
+	}
+	return got, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestParallelBlockDownload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts several libp2p hosts")
+	}
+	miner := newTestAddress(t)
+	chain := []Block{CreateGenesisBlock()}
+	for i := 0; i < 30; i++ {
+		chain = append(chain, GenerateBlock(chain[len(chain)-1], nil, miner, CalcNextBits(chain)))
+	}
+
+	// A fresh node connects to two peers serving the chain and a third that
+	// never answers getchain
+	h, state := newTestNode(t, nil)
+	stalled, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	var servers []peer.ID
+	for i := 0; i < 3; i++ {
+		serverHost, serverState := newTestNode(t, nil)
+		if err := serverState.ReplaceChain(chain); err != nil {
+			t.Fatalf("ReplaceChain() error = %v", err)
+		}
+		if i == 2 {
+			serverHost.SetStreamHandler(ChainProtocol, func(s network.Stream) {
+				<-stalled.Done()
+				s.Reset()
+			})
+		}
+		if err := connectPeer(h, state, peer.AddrInfo{ID: serverHost.ID(), Addrs: serverHost.Addrs()}); err != nil {
+			t.Fatalf("connectPeer() error = %v", err)
+		}
+		servers = append(servers, serverHost.ID())
+	}
+
+	sm := NewSyncManager(h, state)
+	sm.windowSize = 4
+	sm.stallTimeout = 500 * time.Millisecond
+	if err := sm.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+
+	if tip := state.GetLastBlock(); tip.Hash != chain[len(chain)-1].Hash {
+		t.Fatalf("Tip after sync = %d %s, want %d", tip.Index, tip.Hash, len(chain)-1)
+	}
+	progress := sm.Progress()
+	if progress.Phase != SyncPhaseIdle || progress.BlocksConnected != len(chain)-1 || progress.LastError != "" {
+		t.Errorf("Progress() = %+v", progress)
+	}
+	// The stalled window went to another peer, and both working peers
+	// served blocks
+	for _, id := range servers[:2] {
+		if progress.BlocksByPeer[id.String()] == 0 {
+			t.Errorf("Peer %s served no blocks: %v", id, progress.BlocksByPeer)
+		}
+	}
+	if progress.BlocksByPeer[servers[2].String()] != 0 {
+		t.Errorf("Stalled peer counted blocks: %v", progress.BlocksByPeer)
+	}
+
+	// Nothing is left to download
+	if err := sm.Sync(); err != nil || sm.Progress().BlocksConnected != len(chain)-1 {
+		t.Errorf("Second Sync() = %v, progress %+v", err, sm.Progress())
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Block inventory sync on ChainProtocol: a getblocks request carries a block
+// locator and a stop hash, and is answered with an inv message listing the
+// hashes of the main-chain blocks after the last block both chains share, up
+// to the stop hash. A getdata request lists block hashes and is answered with
+// one block or notfound frame per hash, in order, on the same stream. Two
+// nodes that diverged at any height converge without transferring the blocks
+// they share.
+
+// maxInvPerMessage caps the hashes in one inv or getdata message
+const maxInvPerMessage = 500
+
+// ErrMalformedRequest is returned for a request payload that does not decode
+var ErrMalformedRequest = errors.New("malformed request")
+
+// GetBlocks asks for the hashes of the blocks after a locator
+type GetBlocks struct {
+	Locator []string // See BlockLocator
+	Stop    string   // Last hash wanted, or empty for as many as allowed
+}
+
+// serveInventory answers a getblocks request with an inv message
+func serveInventory(s network.Stream, state *BlockchainState, payload []byte) error {
+	req, err := decodeGetBlocks(payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedRequest, err)
+	}
+	hashes := state.BlocksAfter(req.Locator, req.Stop, maxInvPerMessage)
+	return writeMessage(s, Message{Type: MsgInv, Payload: encodeHashes(hashes)})
+}
+
+// serveData answers a getdata request with one frame per requested block
+func serveData(s network.Stream, state *BlockchainState, payload []byte) error {
+	hashes, err := decodeHashes(payload)
+	if err == nil && len(hashes) > maxInvPerMessage {
+		err = fmt.Errorf("%d hashes, more than %d", len(hashes), maxInvPerMessage)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedRequest, err)
+	}
+
+	for _, hash := range hashes {
+		msg := Message{Type: MsgNotFound, Payload: []byte(hash)}
+		if block, ok := state.GetBlockByHash(hash); ok {
+			msg = Message{Type: MsgBlock, Payload: EncodeBlock(block)}
+		}
+		if err := writeMessage(s, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchInventory asks a peer for the hashes of its main-chain blocks after
+// locator, up to stop
+func fetchInventory(h host.Host, from peer.ID, locator []string, stop string) ([]string, error) {
+	req := Message{Type: MsgGetBlocks, Payload: encodeGetBlocks(GetBlocks{Locator: locator, Stop: stop})}
+	reply, err := request(h, from, ChainProtocol, req)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != MsgInv {
+		return nil, fmt.Errorf("unexpected reply %s to getblocks", reply.Type)
+	}
+
+	hashes, err := decodeHashes(reply.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("bad inv reply: %w", err)
+	}
+	if len(hashes) > maxInvPerMessage {
+		return nil, fmt.Errorf("peer sent %d hashes, more than %d", len(hashes), maxInvPerMessage)
+	}
+	return hashes, nil
+}
+
+// fetchData downloads blocks by hash from a peer. It returns the blocks the
+// peer had, in the order of hashes.
+func fetchData(h host.Host, from peer.ID, hashes []string) ([]Block, error) {
+	s, err := openStream(h, from, ChainProtocol, Message{Type: MsgGetData, Payload: encodeHashes(hashes)})
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	var blocks []Block
+	for _, hash := range hashes {
+		msg, err := readMessage(s)
+		if err != nil {
+			return blocks, err
+		}
+		switch msg.Type {
+		case MsgBlock:
+			block, err := DecodeBlock(msg.Payload)
+			if err != nil {
+				return blocks, fmt.Errorf("bad reply for block %s: %w", hash, err)
+			}
+			if block.Hash != hash {
+				return blocks, fmt.Errorf("bad reply for block %s: got block %s", hash, block.Hash)
+			}
+			blocks = append(blocks, block)
+		case MsgNotFound:
+			if string(msg.Payload) != hash {
+				return blocks, fmt.Errorf("notfound for %s, want %s", msg.Payload, hash)
+			}
+		default:
+			return blocks, fmt.Errorf("unexpected reply %s to getdata", msg.Type)
+		}
+	}
+	return blocks, nil
+}
+
+// SyncBlocks downloads the blocks of a peer's main chain that we lack, from
+// the last block both chains share up to stop, or up to the peer's tip if
+// stop is empty, and adds them in chain order
+func SyncBlocks(h host.Host, state *BlockchainState, from peer.ID, stop string) error {
+	locator := state.BlockLocator()
+	for {
+		inv, err := fetchInventory(h, from, locator, stop)
+		if err != nil {
+			return fmt.Errorf("getblocks: %w", err)
+		}
+		if len(inv) == 0 {
+			return nil
+		}
+
+		var missing []string
+		for _, hash := range inv {
+			if _, ok := state.GetBlockByHash(hash); !ok {
+				missing = append(missing, hash)
+			}
+		}
+		if len(missing) > 0 {
+			blocks, err := fetchData(h, from, missing)
+			for _, block := range blocks {
+				if err := state.AddBlockFromPeer(block, from); err != nil &&
+					!errors.Is(err, ErrDuplicateBlock) && !errors.Is(err, ErrOrphanBlock) {
+					penalizePeer(h, state, from, PenaltyInvalidBlock, "invalid block")
+					return fmt.Errorf("rejected block %s: %w", block.Hash, err)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("getdata: %w", err)
+			}
+		}
+
+		if len(inv) < maxInvPerMessage || inv[len(inv)-1] == stop {
+			return nil
+		}
+		locator = []string{inv[len(inv)-1]}
+	}
+}
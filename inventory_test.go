@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestInventorySync(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts libp2p hosts")
+	}
+	chain := []Block{CreateGenesisBlock()}
+	miner := newTestAddress(t)
+	for i := 0; i < 10; i++ {
+		chain = append(chain, GenerateBlock(chain[len(chain)-1], nil, miner, CalcNextBits(chain)))
+	}
+	// Our node shares the first 6 blocks and has a shorter fork of its own
+	fork := append([]Block(nil), chain[:6]...)
+	other := newTestAddress(t)
+	for i := 0; i < 2; i++ {
+		fork = append(fork, GenerateBlock(fork[len(fork)-1], nil, other, CalcNextBits(fork)))
+	}
+
+	serverHost, serverState := newTestNode(t, nil)
+	if err := serverState.ReplaceChain(chain); err != nil {
+		t.Fatalf("ReplaceChain() error = %v", err)
+	}
+	h, state := newTestNode(t, nil)
+	if err := state.ReplaceChain(fork); err != nil {
+		t.Fatalf("ReplaceChain() error = %v", err)
+	}
+	server := peer.AddrInfo{ID: serverHost.ID(), Addrs: serverHost.Addrs()}
+	if err := connectPeer(h, state, server); err != nil {
+		t.Fatalf("connectPeer() error = %v", err)
+	}
+
+	// The inventory starts after the shared prefix and ends at stop
+	inv, err := fetchInventory(h, server.ID, state.BlockLocator(), chain[8].Hash)
+	if err != nil || len(inv) != 3 || inv[0] != chain[6].Hash || inv[2] != chain[8].Hash {
+		t.Fatalf("fetchInventory() = %v, %v, want blocks 6-8", inv, err)
+	}
+	blocks, err := fetchData(h, server.ID, []string{chain[7].Hash, "unknown", chain[6].Hash})
+	if err != nil || len(blocks) != 2 || blocks[0].Hash != chain[7].Hash || blocks[1].Hash != chain[6].Hash {
+		t.Fatalf("fetchData() = %d blocks, %v, want blocks 7 and 6", len(blocks), err)
+	}
+
+	// The node converges on the chain with more work
+	if err := SyncBlocks(h, state, server.ID, ""); err != nil {
+		t.Fatalf("SyncBlocks() error = %v", err)
+	}
+	if tip := state.GetLastBlock(); tip.Hash != chain[len(chain)-1].Hash {
+		t.Errorf("Tip after SyncBlocks() = %d %s, want block %d of the server", tip.Index, tip.Hash, len(chain)-1)
+	}
+}
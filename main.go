@@ -1,15 +1,37 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
 func main() {
+	// Subcommands run instead of the node
+	if len(os.Args) > 1 && os.Args[1] == "nodekey" {
+		if err := runNodeKeyCommand(os.Args[2:]); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Parse command line flags
 	httpPort := flag.String("http", "8080", "HTTP server port")
 	p2pPort := flag.String("p2p", "6001", "P2P network port")
+	dataDir := flag.String("datadir", "", "Data directory (default data/<network>/node-<p2p port>)")
+	network := flag.String("network", DevNetParams.Name, "Built-in network preset (mainnet, testnet, devnet)")
+	paramsFile := flag.String("params", "", "Load network params from a JSON file instead of a preset")
+	minerAddress := flag.String("miner", "", "Address that receives mining rewards (default: node wallet)")
+	banDuration := flag.Duration("banduration", DefaultBanDuration, "How long a misbehaving peer stays banned")
+	bootstrapList := flag.String("bootstrap", "", "Comma-separated multiaddrs of peers to stay connected to, each ending in /p2p/<peer ID>")
+	useDHT := flag.Bool("dht", false, "Discover peers through a Kademlia DHT joined via the bootstrap peers")
+	useMDNS := flag.Bool("mdns", true, "Discover peers on the local network with mDNS")
+	maxMempool := flag.Int("maxmempool", DefaultMaxMempoolBytes>>20, "Maximum size of the pending transactions in MiB")
+	maxMempoolTxs := flag.Int("maxmempooltxs", DefaultMaxMempoolCount, "Maximum number of pending transactions")
+	minRelayFee := flag.String("minrelayfee", DefaultMinRelayFee.String(), "Lowest fee rate the mempool accepts, in coins per 1000 bytes")
 	flag.Parse()
 
 	// Override with positional args if provided
@@ -24,40 +46,153 @@ func main() {
 	fmt.Printf("🚀 Starting blockchain node...\n")
 	fmt.Printf("HTTP Port: %s, P2P Port: %s\n", *httpPort, *p2pPort)
 
+	// Select the network before any block or address is derived
+	var params *NetworkParams
+	var err error
+	if *paramsFile != "" {
+		params, err = LoadNetworkParams(*paramsFile)
+	} else {
+		params, err = NetworkPreset(*network)
+	}
+	if err != nil {
+		fmt.Printf("❌ Failed to load network params: %v\n", err)
+		os.Exit(1)
+	}
+	SetActiveNetwork(params)
+	fmt.Printf("🌐 Network: %s (chain ID %s, genesis %s)\n",
+		params.Name, params.ChainID, params.GenesisHash())
+
+	if *dataDir == "" {
+		*dataDir = filepath.Join("data", params.Name, "node-"+*p2pPort)
+	}
+
+	// Open the on-disk chain store
+	db, err := OpenBoltDB(*dataDir)
+	if err != nil {
+		fmt.Printf("❌ Failed to open database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
 	// Initialize blockchain state
 	state := NewBlockchainState()
+	state.SetDB(db)
 
-	// Create and add genesis block
-	genesisBlock := CreateGenesisBlock()
-	if err := state.AddBlock(genesisBlock); err != nil {
-		fmt.Printf("❌ Failed to add genesis block: %v\n", err)
+	height, err := state.LoadChain()
+	if err != nil {
+		fmt.Printf("❌ Failed to load chain from %s: %v\n", *dataDir, err)
 		os.Exit(1)
 	}
 
-	// Initialize wallet
-	wallet, err := NewWallet()
+	if height == 0 {
+		// Fresh data directory: create and add genesis block
+		genesisBlock := CreateGenesisBlock()
+		if err := state.AddBlock(genesisBlock); err != nil {
+			fmt.Printf("❌ Failed to add genesis block: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		fmt.Printf("📂 Loaded %d blocks from %s\n", height, *dataDir)
+	}
+
+	// Bound the mempool so a flood of transactions cannot exhaust memory
+	relayFee, err := ParseFeeRate(*minRelayFee)
 	if err != nil {
-		fmt.Printf("❌ Failed to create wallet: %v\n", err)
+		fmt.Printf("❌ Invalid -minrelayfee: %v\n", err)
+		os.Exit(1)
+	}
+	if *maxMempool <= 0 || *maxMempoolTxs <= 0 {
+		fmt.Printf("❌ -maxmempool and -maxmempooltxs must be positive\n")
+		os.Exit(1)
+	}
+	state.SetMempoolPolicy(MempoolPolicy{
+		MaxBytes:    *maxMempool << 20,
+		MaxCount:    *maxMempoolTxs,
+		MinRelayFee: relayFee,
+	})
+
+	// The wallet key lives in the data directory like the chain it is paid on
+	wallet, err := LoadOrCreateWallet(*dataDir)
+	if err != nil {
+		fmt.Printf("❌ Failed to load wallet: %v\n", err)
 		os.Exit(1)
 	}
 	state.SetWallet(wallet)
+	fmt.Printf("👛 Wallet address: %s\n", wallet.GetAddress())
+
+	if *minerAddress != "" {
+		if err := ValidateAddress(*minerAddress); err != nil {
+			fmt.Printf("❌ Invalid miner address: %v\n", err)
+			os.Exit(1)
+		}
+		state.SetMinerAddress(*minerAddress)
+	}
+	fmt.Printf("⛏️  Mining rewards go to: %s\n", state.GetMinerAddress())
+
+	// Peer bans survive restarts in the chain database
+	bans, err := NewBanManager(db, *banDuration)
+	if err != nil {
+		fmt.Printf("❌ Failed to load peer bans: %v\n", err)
+		os.Exit(1)
+	}
+	state.SetBanManager(bans)
+
+	// Peers the node has talked to before are redialed on startup
+	addrBook, err := NewAddressBook(db)
+	if err != nil {
+		fmt.Printf("❌ Failed to load address book: %v\n", err)
+		os.Exit(1)
+	}
+	state.SetAddressBook(addrBook)
+
+	bootstrapPeers, err := ParseBootstrapPeers(*bootstrapList)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+
+	// The node key keeps the peer ID stable across restarts
+	nodeKey, err := LoadOrCreateNodeKey(*dataDir)
+	if err != nil {
+		fmt.Printf("❌ Failed to load node key: %v\n", err)
+		os.Exit(1)
+	}
 
 	// Initialize P2P host with specific port
-	p2pHost, err := CreateLibp2pHost(*p2pPort)
+	p2pHost, err := CreateLibp2pHost(*p2pPort, nodeKey, bans)
 	if err != nil {
 		fmt.Printf("❌ Failed to create libp2p host: %v\n", err)
 		os.Exit(1)
 	}
 	state.SetP2PHost(p2pHost)
 
-	// Setup P2P discovery and stream handler
-	if err := SetupDiscovery(p2pHost); err != nil {
-		fmt.Printf("❌ Failed to setup discovery: %v\n", err)
-		os.Exit(1)
-	}
+	// Register the protocols before any peer is contacted
 	SetupStreamHandler(p2pHost, state)
+	SetupBlockHandler(p2pHost, state)
+	SetupGossipHandlers(p2pHost, state)
+
+	// Download blocks from peers ahead of us
+	ctx := context.Background()
+	syncManager := NewSyncManager(p2pHost, state)
+	state.SetSyncManager(syncManager)
+	go syncManager.Run(ctx)
+
+	// Setup P2P discovery
+	if *useMDNS {
+		if err := SetupDiscovery(p2pHost, state); err != nil {
+			fmt.Printf("❌ Failed to setup discovery: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	ConnectBootstrapPeers(ctx, p2pHost, state, bootstrapPeers)
+	DialKnownPeers(p2pHost, state)
+	if *useDHT {
+		if _, err := StartDHTDiscovery(ctx, p2pHost, state, bootstrapPeers); err != nil {
+			fmt.Printf("❌ Failed to start DHT discovery: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	fmt.Println("🔍 DEBUG: Starting server initialization...")
 	server := NewServer(state)
 
 	// Start server with error handling
@@ -76,6 +211,8 @@ func main() {
 	fmt.Println("   POST /transaction - Create a new transaction")
 	fmt.Println("   GET  /mine        - Mine a new block")
 	fmt.Println("   GET  /peers       - View connected peers")
+	fmt.Println("   GET  /balance     - View the wallet balance")
+	fmt.Println("   GET  /sync        - View the block download progress")
 
 	// Start CLI
 	fmt.Println("\n💻 Starting CLI interface...")
@@ -1,63 +1,624 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"sync"
 	"time"
 )
 
+// The mempool indexes pending transactions by fee rate, the fee per 1000
+// bytes of encoded transaction. A transaction may spend outputs of other
+// pending transactions. Block templates take a transaction together with its
+// unconfirmed ancestors and rank these packages by their combined fee rate,
+// so a high-fee child also pays for mining its low-fee parent.
+
+// maxMempoolAncestors caps the unconfirmed ancestors of a pending transaction
+const maxMempoolAncestors = 25
+
+// Replace-by-fee: a transaction spending outputs that pending transactions
+// already spend replaces them, and everything spending from them, if it pays
+// more than all of them together plus mempoolFeeIncrement for its own size,
+// and a higher fee rate than each transaction it conflicts with. The limits
+// keep a sender from churning the pool with cheap replacements.
+const (
+	maxReplacementEvictions = 100 // Transactions one replacement may evict
+	maxReplacements         = 10  // Successive replacements of the same spend
+)
+
+// When the pool is full the lowest fee rate entries are evicted, and the
+// pool's minimum fee rises to what they paid plus mempoolFeeIncrement. The
+// raised minimum halves every mempoolMinFeeHalfLife, down to MinRelayFee.
+const (
+	mempoolFeeIncrement   FeeRate = 1000
+	mempoolMinFeeHalfLife         = time.Hour
+)
+
+// Default mempool limits
+const (
+	DefaultMaxMempoolBytes         = 64 << 20
+	DefaultMaxMempoolCount         = 50000
+	DefaultMinRelayFee     FeeRate = 1000 // 0.00001 coin per 1000 bytes
+)
+
+// blockTemplateReserve is the room a template leaves for the block header
+// and the coinbase transaction
+const blockTemplateReserve = 4 << 10
+
+// ErrMempoolConflict is returned when a transaction spends an output that a
+// pending transaction already spends
+var ErrMempoolConflict = errors.New("output already spent by a pending transaction")
+
+// ErrTooManyAncestors is returned for a transaction that would have more
+// than maxMempoolAncestors unconfirmed ancestors
+var ErrTooManyAncestors = errors.New("too many unconfirmed ancestors")
+
+// Fee rejections
+var (
+	ErrFeeTooLow   = errors.New("fee rate below the mempool minimum")
+	ErrMempoolFull = errors.New("mempool full")
+)
+
+// ErrReplacementLimit is returned for a replacement that would evict too
+// many transactions or extend too long a chain of replacements
+var ErrReplacementLimit = errors.New("replacement limit exceeded")
+
+// RejectReason says why the mempool refused a transaction
+type RejectReason string
+
+const (
+	RejectInvalid          RejectReason = "invalid"
+	RejectDuplicate        RejectReason = "duplicate"
+	RejectConflict         RejectReason = "conflict" // Spends pending outputs without paying enough to replace
+	RejectReplacementLimit RejectReason = "replacement-limit"
+	RejectTooManyAncestors RejectReason = "too-many-ancestors"
+	RejectFeeTooLow        RejectReason = "fee-too-low"     // Below MinRelayFee
+	RejectMempoolMinFee    RejectReason = "mempool-min-fee" // Below the raised minimum of a full pool
+	RejectMempoolFull      RejectReason = "mempool-full"
+)
+
+// RejectError is returned by Mempool.AddTransaction. It wraps the underlying
+// error, so errors.Is still matches sentinels such as ErrMempoolConflict.
+type RejectError struct {
+	Reason RejectReason
+	MinFee FeeRate // Fee rate the pool required, for fee rejections
+	Err    error
+}
+
+func (e *RejectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RejectError) Unwrap() error {
+	return e.Err
+}
+
+func reject(reason RejectReason, err error) *RejectError {
+	return &RejectError{Reason: reason, Err: err}
+}
+
+// MempoolPolicy bounds the mempool and sets the lowest fee it accepts
+type MempoolPolicy struct {
+	MaxBytes    int     // Encoded bytes of all pending transactions
+	MaxCount    int     // Number of pending transactions
+	MinRelayFee FeeRate // Lowest fee rate accepted however empty the pool is
+}
+
+// DefaultMempoolPolicy is the policy of a new mempool
+var DefaultMempoolPolicy = MempoolPolicy{
+	MaxBytes:    DefaultMaxMempoolBytes,
+	MaxCount:    DefaultMaxMempoolCount,
+	MinRelayFee: DefaultMinRelayFee,
+}
+
+// mempoolEntry is a pending transaction and its links to the pending
+// transactions it spends from and that spend from it
+type mempoolEntry struct {
+	tx       Transaction
+	size     int // Encoded bytes
+	feeRate  FeeRate
+	added    time.Time
+	parents  map[string]bool
+	children map[string]bool
+
+	replacements int // Pending transactions this one replaced in a row
+}
+
+// before orders entries by fee rate, highest first, then by arrival
+func (e *mempoolEntry) before(other *mempoolEntry) bool {
+	if e.feeRate != other.feeRate {
+		return e.feeRate > other.feeRate
+	}
+	if !e.added.Equal(other.added) {
+		return e.added.Before(other.added)
+	}
+	return e.tx.TxID < other.tx.TxID
+}
+
 type Mempool struct {
-	transactions map[string]Transaction
-	mutex        sync.RWMutex
+	entries   map[string]*mempoolEntry
+	byFeeRate []*mempoolEntry     // Highest fee rate first
+	spent     map[Outpoint]string // outpoint -> TxID of the pending spender
+	bytes     int                 // Encoded bytes of all entries
+	utxos     *UTXOSet
+	policy    MempoolPolicy
+
+	// Minimum fee raised by evictions, and when it was raised
+	rollingMinFee FeeRate
+	minFeeRaised  time.Time
+
+	mutex sync.RWMutex
 }
 
-func NewMempool() *Mempool {
+func NewMempool(utxos *UTXOSet) *Mempool {
 	return &Mempool{
-		transactions: make(map[string]Transaction),
+		entries: make(map[string]*mempoolEntry),
+		spent:   make(map[Outpoint]string),
+		utxos:   utxos,
+		policy:  DefaultMempoolPolicy,
 	}
 }
 
+// SetPolicy changes the limits and minimum relay fee. A pool over the new
+// limits is trimmed right away.
+func (m *Mempool) SetPolicy(policy MempoolPolicy) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.policy = policy
+	m.trim()
+}
+
+// MinFee returns the lowest fee rate the pool currently accepts
+func (m *Mempool) MinFee() FeeRate {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.minFee(time.Now())
+}
+
+// minFee returns MinRelayFee or the decayed minimum raised by evictions,
+// whichever is higher. Callers must hold the mutex.
+func (m *Mempool) minFee(now time.Time) FeeRate {
+	rate := m.policy.MinRelayFee
+	if m.rollingMinFee > 0 {
+		halfLives := float64(now.Sub(m.minFeeRaised)) / float64(mempoolMinFeeHalfLife)
+		if decayed := FeeRate(float64(m.rollingMinFee) * math.Exp2(-halfLives)); decayed > rate {
+			rate = decayed
+		}
+	}
+	return rate
+}
+
+// BlockTemplate is the selection of pending transactions for the next block
+type BlockTemplate struct {
+	Transactions []Transaction `json:"transactions"` // Parents before children
+	Fees         Amount        `json:"fees"`
+	Size         int           `json:"size"` // Encoded bytes of the transactions
+}
+
+// AddTransaction validates a transaction and adds it to the pool, evicting
+// the lowest fee rate entries if the pool grows over its limits. Rejections
+// are *RejectError.
 func (m *Mempool) AddTransaction(tx Transaction) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	if !ValidateTransaction(tx, []byte(tx.SenderAddress)) {
-		return fmt.Errorf("invalid transaction")
+	if tx.IsCoinbase() {
+		return reject(RejectInvalid, fmt.Errorf("coinbase transactions are only valid inside a block"))
+	}
+
+	if err := CheckTransaction(tx); err != nil {
+		return reject(RejectInvalid, fmt.Errorf("invalid transaction: %w", err))
+	}
+
+	if _, exists := m.entries[tx.TxID]; exists {
+		return reject(RejectDuplicate, fmt.Errorf("transaction %s already in mempool", tx.TxID))
+	}
+
+	conflicts := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		if spender, ok := m.spent[in.Outpoint()]; ok {
+			conflicts[spender] = true
+		}
+	}
+
+	// The transaction can at the earliest be mined in the next block
+	if err := CheckTransactionInputs(tx, mempoolView{m}, m.utxos.Height()+1); err != nil {
+		return reject(RejectInvalid, fmt.Errorf("invalid transaction: %w", err))
+	}
+
+	now := time.Now()
+	size := len(EncodeTransaction(tx))
+	entry := &mempoolEntry{
+		tx:       tx,
+		size:     size,
+		feeRate:  NewFeeRate(tx.Fee, size),
+		added:    now,
+		parents:  make(map[string]bool),
+		children: make(map[string]bool),
+	}
+	if minFee := m.minFee(now); entry.feeRate < minFee {
+		reason := RejectFeeTooLow
+		if minFee > m.policy.MinRelayFee {
+			reason = RejectMempoolMinFee
+		}
+		return &RejectError{Reason: reason, MinFee: minFee,
+			Err: fmt.Errorf("%w: %s pays %s, need %s", ErrFeeTooLow, tx.TxID, entry.feeRate, minFee)}
 	}
 
-	m.transactions[tx.TxID] = tx
+	replaced, err := m.checkReplacement(entry, conflicts)
+	if err != nil {
+		return err
+	}
+
+	for _, in := range tx.Inputs {
+		if _, ok := m.entries[in.TxID]; ok {
+			entry.parents[in.TxID] = true
+		}
+	}
+	if n := len(m.ancestors(entry)) - 1; n > maxMempoolAncestors {
+		return reject(RejectTooManyAncestors, fmt.Errorf("%w: %d, limit %d", ErrTooManyAncestors, n, maxMempoolAncestors))
+	}
+
+	for _, old := range replaced {
+		fmt.Printf("♻️ Transaction %s replaces %s\n", tx.TxID, old.tx.TxID)
+		m.removeTransaction(old.tx.TxID)
+	}
+
+	// After a reorg, pending transactions may already spend the outputs of
+	// a transaction returning from a disconnected block
+	for i := range tx.Outputs {
+		if spender, ok := m.spent[Outpoint{TxID: tx.TxID, Index: i}]; ok {
+			entry.children[spender] = true
+			m.entries[spender].parents[tx.TxID] = true
+		}
+	}
+	m.entries[tx.TxID] = entry
+	m.bytes += size
+	for parent := range entry.parents {
+		m.entries[parent].children[tx.TxID] = true
+	}
+	for _, in := range tx.Inputs {
+		m.spent[in.Outpoint()] = tx.TxID
+	}
+	i := sort.Search(len(m.byFeeRate), func(i int) bool { return entry.before(m.byFeeRate[i]) })
+	m.byFeeRate = append(m.byFeeRate, nil)
+	copy(m.byFeeRate[i+1:], m.byFeeRate[i:])
+	m.byFeeRate[i] = entry
+
+	m.trim()
+	if _, ok := m.entries[tx.TxID]; !ok {
+		return &RejectError{Reason: RejectMempoolFull, MinFee: m.minFee(now),
+			Err: fmt.Errorf("%w: %s pays %s, too little to evict other transactions", ErrMempoolFull, tx.TxID, entry.feeRate)}
+	}
 	return nil
 }
 
+// checkReplacement applies the replace-by-fee rules to a transaction
+// spending outputs the conflicting pending transactions already spend. It
+// returns the transactions the entry replaces, descendants first. Callers
+// must hold the mutex.
+func (m *Mempool) checkReplacement(entry *mempoolEntry, conflicts map[string]bool) ([]*mempoolEntry, error) {
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+	tx := entry.tx
+
+	var replaced []*mempoolEntry
+	seen := make(map[string]bool)
+	var collect func(txID string)
+	collect = func(txID string) {
+		if seen[txID] {
+			return
+		}
+		seen[txID] = true
+		for child := range m.entries[txID].children {
+			collect(child)
+		}
+		replaced = append(replaced, m.entries[txID])
+	}
+	for txID := range conflicts {
+		conflict := m.entries[txID]
+		if entry.feeRate <= conflict.feeRate {
+			return nil, reject(RejectConflict, fmt.Errorf("%w: %s pays %s, not more than the %s of %s",
+				ErrMempoolConflict, tx.TxID, entry.feeRate, conflict.feeRate, txID))
+		}
+		if conflict.replacements+1 > entry.replacements {
+			entry.replacements = conflict.replacements + 1
+		}
+		collect(txID)
+	}
+	if entry.replacements > maxReplacements {
+		return nil, reject(RejectReplacementLimit, fmt.Errorf("%w: %s would be replacement %d in a row, limit %d",
+			ErrReplacementLimit, tx.TxID, entry.replacements, maxReplacements))
+	}
+	if len(replaced) > maxReplacementEvictions {
+		return nil, reject(RejectReplacementLimit, fmt.Errorf("%w: %s would evict %d transactions, limit %d",
+			ErrReplacementLimit, tx.TxID, len(replaced), maxReplacementEvictions))
+	}
+
+	for _, in := range tx.Inputs {
+		if seen[in.TxID] {
+			return nil, reject(RejectInvalid, fmt.Errorf("invalid transaction: %s spends an output of %s, which it replaces",
+				tx.TxID, in.TxID))
+		}
+	}
+
+	var replacedFees Amount
+	for _, old := range replaced {
+		replacedFees += old.tx.Fee // Bounded by MaxMoney
+	}
+	if needed := replacedFees + mempoolFeeIncrement.Fee(entry.size); tx.Fee < needed {
+		return nil, reject(RejectConflict, fmt.Errorf("%w: %s pays %s, replacing needs at least %s",
+			ErrMempoolConflict, tx.TxID, tx.Fee, needed))
+	}
+	return replaced, nil
+}
+
+// trim evicts the lowest fee rate entries, with the transactions spending
+// from them, until the pool is within its limits, and raises the minimum fee
+// above what they paid. Callers must hold the mutex.
+func (m *Mempool) trim() {
+	now := time.Now()
+	for len(m.byFeeRate) > 0 && (m.bytes > m.policy.MaxBytes || len(m.byFeeRate) > m.policy.MaxCount) {
+		lowest := m.byFeeRate[len(m.byFeeRate)-1]
+		m.removeWithDescendants(lowest.tx.TxID)
+		fmt.Printf("🗑️ Evicted transaction %s paying %s from the full mempool\n", lowest.tx.TxID, lowest.feeRate)
+
+		if raised := lowest.feeRate + mempoolFeeIncrement; raised > m.minFee(now) {
+			m.rollingMinFee = raised
+			m.minFeeRaised = now
+		}
+	}
+}
+
+// GetTransactions returns the pending transactions, highest fee rate first
 func (m *Mempool) GetTransactions() []Transaction {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
-	txs := make([]Transaction, 0, len(m.transactions))
-	for _, tx := range m.transactions {
-		txs = append(txs, tx)
+	txs := make([]Transaction, 0, len(m.byFeeRate))
+	for _, entry := range m.byFeeRate {
+		txs = append(txs, entry.tx)
 	}
 	return txs
 }
 
+// GetTransaction returns a pending transaction by TxID
+func (m *Mempool) GetTransaction(txID string) (Transaction, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry, ok := m.entries[txID]
+	if !ok {
+		return Transaction{}, false
+	}
+	return entry.tx, true
+}
+
+// FeeRateAtDepth returns the fee rate a new transaction needs to be among
+// the first bytes of pending transactions, or zero if all of them fit
+func (m *Mempool) FeeRateAtDepth(bytes int) FeeRate {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	size := 0
+	for _, entry := range m.byFeeRate {
+		if size += entry.size; size > bytes {
+			return entry.feeRate + 1
+		}
+	}
+	return 0
+}
+
+// IsSpent reports whether a pending transaction already spends the outpoint
+func (m *Mempool) IsSpent(op Outpoint) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, ok := m.spent[op]
+	return ok
+}
+
+// BlockTemplate selects pending transactions for a block whose transactions
+// take at most maxSize encoded bytes. Packages of a transaction and its
+// unconfirmed ancestors are taken in order of their combined fee rate, and
+// every transaction follows the parents it spends from. A package that does
+// not fit is skipped for smaller ones further down.
+func (m *Mempool) BlockTemplate(maxSize int) BlockTemplate {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	type txPackage struct {
+		entries []*mempoolEntry // Ancestors first, the transaction last
+		feeRate FeeRate
+	}
+	packages := make([]txPackage, 0, len(m.byFeeRate))
+	for _, entry := range m.byFeeRate {
+		var fees Amount
+		size := 0
+		ancestors := m.ancestors(entry)
+		for _, e := range ancestors {
+			fees += e.tx.Fee // Bounded by MaxMoney
+			size += e.size
+		}
+		packages = append(packages, txPackage{entries: ancestors, feeRate: NewFeeRate(fees, size)})
+	}
+	sort.SliceStable(packages, func(i, j int) bool { return packages[i].feeRate > packages[j].feeRate })
+
+	var template BlockTemplate
+	included := make(map[string]bool)
+	for _, pkg := range packages {
+		var missing []*mempoolEntry
+		size := 0
+		for _, e := range pkg.entries {
+			if !included[e.tx.TxID] {
+				missing = append(missing, e)
+				size += e.size
+			}
+		}
+		if len(missing) == 0 || template.Size+size > maxSize {
+			continue
+		}
+		for _, e := range missing {
+			included[e.tx.TxID] = true
+			template.Transactions = append(template.Transactions, e.tx)
+			template.Fees += e.tx.Fee
+		}
+		template.Size += size
+	}
+	return template
+}
+
+// RemoveTransactions drops transactions that a block confirmed. Pending
+// transactions spending their outputs stay and now spend confirmed outputs.
 func (m *Mempool) RemoveTransactions(txs []Transaction) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
 	for _, tx := range txs {
-		delete(m.transactions, tx.TxID)
+		m.removeTransaction(tx.TxID)
+	}
+}
+
+// BlockConnected drops the transactions a new main-chain block confirmed,
+// and the pending transactions spending the same outputs together with the
+// transactions spending from them
+func (m *Mempool) BlockConnected(block Block) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, tx := range block.Transactions {
+		for _, in := range tx.Inputs {
+			if spender, ok := m.spent[in.Outpoint()]; ok && spender != tx.TxID {
+				fmt.Printf("🗑️ Dropping transaction %s, conflicts with block %d\n", spender, block.Index)
+				m.removeWithDescendants(spender)
+			}
+		}
+		m.removeTransaction(tx.TxID)
+	}
+}
+
+// Revalidate drops the pending transactions, and those spending from them,
+// that are no longer valid on top of the current UTXO set, e.g. because a
+// reorg took away the outputs they spend or made a coinbase immature again
+func (m *Mempool) Revalidate() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	spendHeight := m.utxos.Height() + 1
+	for _, entry := range append([]*mempoolEntry(nil), m.byFeeRate...) {
+		if _, ok := m.entries[entry.tx.TxID]; !ok {
+			continue // Went with an invalid ancestor
+		}
+		if err := CheckTransactionInputs(entry.tx, mempoolView{m}, spendHeight); err != nil {
+			fmt.Printf("🗑️ Dropping transaction %s: %v\n", entry.tx.TxID, err)
+			m.removeWithDescendants(entry.tx.TxID)
+		}
 	}
 }
 
-// Cleanup old transactions
+// removeTransaction drops a transaction and releases its inputs.
+// Callers must hold the mutex.
+func (m *Mempool) removeTransaction(txID string) {
+	entry, ok := m.entries[txID]
+	if !ok {
+		return
+	}
+	for _, in := range entry.tx.Inputs {
+		if m.spent[in.Outpoint()] == txID {
+			delete(m.spent, in.Outpoint())
+		}
+	}
+	for parent := range entry.parents {
+		delete(m.entries[parent].children, txID)
+	}
+	for child := range entry.children {
+		delete(m.entries[child].parents, txID)
+	}
+	delete(m.entries, txID)
+	m.bytes -= entry.size
+
+	i := sort.Search(len(m.byFeeRate), func(i int) bool { return !m.byFeeRate[i].before(entry) })
+	for ; i < len(m.byFeeRate); i++ {
+		if m.byFeeRate[i] == entry {
+			m.byFeeRate = append(m.byFeeRate[:i], m.byFeeRate[i+1:]...)
+			break
+		}
+	}
+}
+
+// removeWithDescendants drops a transaction and every pending transaction
+// spending from it. Callers must hold the mutex.
+func (m *Mempool) removeWithDescendants(txID string) {
+	entry, ok := m.entries[txID]
+	if !ok {
+		return
+	}
+	for child := range entry.children {
+		m.removeWithDescendants(child)
+	}
+	m.removeTransaction(txID)
+}
+
+// ancestors returns the unconfirmed ancestors of an entry followed by the
+// entry itself, every transaction after its parents. Callers must hold the
+// mutex.
+func (m *Mempool) ancestors(entry *mempoolEntry) []*mempoolEntry {
+	var order []*mempoolEntry
+	seen := make(map[string]bool)
+	var visit func(e *mempoolEntry)
+	visit = func(e *mempoolEntry) {
+		if seen[e.tx.TxID] {
+			return
+		}
+		seen[e.tx.TxID] = true
+		parents := make([]string, 0, len(e.parents))
+		for parent := range e.parents {
+			parents = append(parents, parent)
+		}
+		sort.Strings(parents)
+		for _, parent := range parents {
+			visit(m.entries[parent])
+		}
+		order = append(order, e)
+	}
+	visit(entry)
+	return order
+}
+
+// Cleanup old transactions. Transactions spending their outputs go too.
 func (m *Mempool) CleanupOldTransactions(maxAge time.Duration) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
 	now := time.Now()
-	for txID, tx := range m.transactions {
-		if now.Sub(tx.Timestamp) > maxAge {
-			delete(m.transactions, txID)
+	for txID, entry := range m.entries {
+		if now.Sub(entry.tx.Timestamp) > maxAge {
+			m.removeWithDescendants(txID)
 		}
 	}
 }
+
+// mempoolView overlays the outputs of pending transactions on the UTXO set.
+// They count as created in the next block. Callers must hold the mutex.
+type mempoolView struct {
+	m *Mempool
+}
+
+func (v mempoolView) GetUTXO(op Outpoint) (UTXO, bool) {
+	if utxo, ok := v.m.utxos.GetUTXO(op); ok {
+		return utxo, true
+	}
+	entry, ok := v.m.entries[op.TxID]
+	if !ok || op.Index < 0 || op.Index >= len(entry.tx.Outputs) {
+		return UTXO{}, false
+	}
+	out := entry.tx.Outputs[op.Index]
+	return UTXO{
+		TxID:    op.TxID,
+		Index:   op.Index,
+		Amount:  out.Amount,
+		Address: out.Address,
+		Height:  v.m.utxos.Height() + 1,
+	}, true
+}
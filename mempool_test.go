@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// newFundedState returns a chain whose genesis block pays 10 coins to the
+// wallet in each of n outputs
+func newFundedState(t *testing.T, wallet *Wallet, n int) *BlockchainState {
+	params := DevNetParams
+	for i := 0; i < n; i++ {
+		params.GenesisAllocations = append(params.GenesisAllocations,
+			GenesisAllocation{Address: wallet.GetAddress(), Amount: Coins(10)})
+	}
+	SetActiveNetwork(&params)
+	t.Cleanup(func() { SetActiveNetwork(&DevNetParams) })
+
+	state := NewBlockchainState()
+	if err := state.AddBlock(CreateGenesisBlock()); err != nil {
+		t.Fatalf("Failed to add genesis block: %v", err)
+	}
+	return state
+}
+
+// selfPayment spends one output of the wallet back to itself
+func selfPayment(t *testing.T, wallet *Wallet, utxo UTXO, amount, fee Amount) Transaction {
+	tx, err := wallet.CreateTransaction([]UTXO{utxo}, wallet.GetAddress(), amount, fee)
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	if err := wallet.SignTransaction(&tx); err != nil {
+		t.Fatalf("Failed to sign transaction: %v", err)
+	}
+	return tx
+}
+
+func TestBlockTemplateByFeeRate(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	state := newFundedState(t, wallet, 2)
+	genesis := state.GetLastBlock()
+
+	spend := func(utxo UTXO, amount, fee Amount) Transaction {
+		tx := selfPayment(t, wallet, utxo, amount, fee)
+		if err := state.AddTransaction(tx); err != nil {
+			t.Fatalf("AddTransaction() error = %v", err)
+		}
+		return tx
+	}
+
+	// A low-fee parent, a high-fee child spending it, and an unrelated
+	// transaction in between
+	utxos := state.GetUTXOSet().FindByAddress(wallet.GetAddress())
+	parent := spend(utxos[0], Coins(2), 1000)
+	child := spend(UTXO{TxID: parent.TxID, Index: 0, Amount: Coins(2), Address: wallet.GetAddress()}, Coins(1), 100000)
+	other := spend(utxos[1], Coins(1), 10000)
+
+	pending := state.GetPendingTransactions()
+	if len(pending) != 3 || pending[0].TxID != child.TxID || pending[1].TxID != other.TxID || pending[2].TxID != parent.TxID {
+		t.Errorf("GetPendingTransactions() is not ordered by fee rate")
+	}
+
+	// The child pays for its parent, which must come first
+	template := state.GetBlockTemplate()
+	if len(template.Transactions) != 3 || template.Transactions[0].TxID != parent.TxID ||
+		template.Transactions[1].TxID != child.TxID || template.Transactions[2].TxID != other.TxID {
+		t.Errorf("GetBlockTemplate() = %v, want parent, child, other", template.Transactions)
+	}
+	if template.Fees != 111000 {
+		t.Errorf("Template fees = %s, want %s", template.Fees, Amount(111000))
+	}
+
+	// Only a single transaction fits, and the package of two does not
+	template = state.mempool.BlockTemplate(len(EncodeTransaction(other)))
+	if len(template.Transactions) != 1 || template.Transactions[0].TxID != other.TxID {
+		t.Errorf("BlockTemplate() over a size limit = %d transactions, want only the unrelated one", len(template.Transactions))
+	}
+
+	// Consensus accepts the full template
+	template = state.GetBlockTemplate()
+	block := GenerateBlock(genesis, template.Transactions, wallet.GetAddress(), state.GetNextBits())
+	if err := state.AddBlock(block); err != nil {
+		t.Fatalf("AddBlock() of the template error = %v", err)
+	}
+}
+
+func TestMempoolLimits(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	state := newFundedState(t, wallet, 4)
+	utxos := state.GetUTXOSet().FindByAddress(wallet.GetAddress())
+	state.SetMempoolPolicy(MempoolPolicy{MaxBytes: 1 << 20, MaxCount: 2, MinRelayFee: DefaultMinRelayFee})
+
+	rejection := func(err error) RejectReason {
+		var rejectErr *RejectError
+		if !errors.As(err, &rejectErr) {
+			return ""
+		}
+		return rejectErr.Reason
+	}
+
+	free := selfPayment(t, wallet, utxos[0], Coins(1), 0)
+	if err := state.AddTransaction(free); rejection(err) != RejectFeeTooLow || !errors.Is(err, ErrFeeTooLow) {
+		t.Errorf("AddTransaction() without a fee error = %v, want %s", err, RejectFeeTooLow)
+	}
+
+	// A third transaction evicts the cheapest of the first two
+	cheap := selfPayment(t, wallet, utxos[0], Coins(1), 1000)
+	mid := selfPayment(t, wallet, utxos[1], Coins(1), 10000)
+	rich := selfPayment(t, wallet, utxos[2], Coins(1), 100000)
+	for _, tx := range []Transaction{cheap, mid, rich} {
+		if err := state.AddTransaction(tx); err != nil {
+			t.Fatalf("AddTransaction() error = %v", err)
+		}
+	}
+	pending := state.GetPendingTransactions()
+	if len(pending) != 2 || pending[0].TxID != rich.TxID || pending[1].TxID != mid.TxID {
+		t.Errorf("Pending after eviction = %d transactions, want rich and mid", len(pending))
+	}
+
+	// The pool now asks for more than the evicted transaction paid
+	minFee := state.GetMempoolMinFee()
+	if minFee <= NewFeeRate(cheap.Fee, len(EncodeTransaction(cheap))) {
+		t.Errorf("Minimum fee after eviction = %s, want above the evicted rate", minFee)
+	}
+	again := selfPayment(t, wallet, utxos[3], Coins(1), 1000)
+	if err := state.AddTransaction(again); rejection(err) != RejectMempoolMinFee {
+		t.Errorf("AddTransaction() below the raised minimum error = %v, want %s", err, RejectMempoolMinFee)
+	}
+	if err := state.AddTransaction(mid); rejection(err) != RejectDuplicate {
+		t.Errorf("AddTransaction() of a pending transaction error = %v, want %s", err, RejectDuplicate)
+	}
+}
+
+func TestMempoolFollowsChain(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	state := newFundedState(t, wallet, 2)
+	genesis := state.GetLastBlock()
+	utxos := state.GetUTXOSet().FindByAddress(wallet.GetAddress())
+
+	parent := selfPayment(t, wallet, utxos[0], Coins(2), 10000)
+	child := selfPayment(t, wallet, UTXO{TxID: parent.TxID, Index: 0, Amount: Coins(2), Address: wallet.GetAddress()}, Coins(1), 10000)
+	pending := selfPayment(t, wallet, utxos[1], Coins(1), 10000)
+	conflict := selfPayment(t, wallet, utxos[1], Coins(3), 10000)
+	for _, tx := range []Transaction{parent, child, pending} {
+		if err := state.AddTransaction(tx); err != nil {
+			t.Fatalf("AddTransaction() error = %v", err)
+		}
+	}
+
+	// The block confirms the parent and double-spends the other transaction
+	block := GenerateBlock(genesis, []Transaction{parent, conflict}, newTestAddress(t), state.GetNextBits())
+	if err := state.AddBlock(block); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+	if txs := state.GetPendingTransactions(); len(txs) != 1 || txs[0].TxID != child.TxID {
+		t.Errorf("Pending after the block = %d transactions, want only the child", len(txs))
+	}
+
+	// A longer branch without the block returns its transactions
+	branch := []Block{genesis}
+	for i := 0; i < 2; i++ {
+		branch = append(branch, GenerateBlock(branch[len(branch)-1], nil, newTestAddress(t), CalcNextBits(branch)))
+	}
+	if err := state.ReplaceChain(branch); err != nil {
+		t.Fatalf("ReplaceChain() error = %v", err)
+	}
+	if txs := state.GetPendingTransactions(); len(txs) != 3 {
+		t.Errorf("Pending after the reorg = %d transactions, want the block's two and the child", len(txs))
+	}
+	position := make(map[string]int)
+	for i, tx := range state.GetBlockTemplate().Transactions {
+		position[tx.TxID] = i + 1
+	}
+	if len(position) != 3 || position[parent.TxID] > position[child.TxID] {
+		t.Errorf("Template after the reorg = %v, want all three with the parent before the child", position)
+	}
+}
+
+func TestReplaceByFee(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	state := newFundedState(t, wallet, 1)
+	utxo := state.GetUTXOSet().FindByAddress(wallet.GetAddress())[0]
+
+	original := selfPayment(t, wallet, utxo, Coins(2), 10000)
+	child := selfPayment(t, wallet, UTXO{TxID: original.TxID, Index: 0, Amount: Coins(2), Address: wallet.GetAddress()}, Coins(1), 10000)
+	for _, tx := range []Transaction{original, child} {
+		if err := state.AddTransaction(tx); err != nil {
+			t.Fatalf("AddTransaction() error = %v", err)
+		}
+	}
+
+	bump := func(tx Transaction, fee Amount) (Transaction, error) {
+		bumped, err := wallet.BumpFee(tx, fee)
+		if err != nil {
+			t.Fatalf("BumpFee() error = %v", err)
+		}
+		if err := wallet.SignTransaction(&bumped); err != nil {
+			t.Fatalf("Failed to sign transaction: %v", err)
+		}
+		return bumped, state.AddTransaction(bumped)
+	}
+
+	// The replacement must also pay for the child it evicts
+	if _, err := bump(original, 15000); !errors.Is(err, ErrMempoolConflict) {
+		t.Errorf("Replacement paying less than the replaced fees error = %v, want %v", err, ErrMempoolConflict)
+	}
+	replacement, err := bump(original, 50000)
+	if err != nil {
+		t.Fatalf("Replacement error = %v", err)
+	}
+	if pending := state.GetPendingTransactions(); len(pending) != 1 || pending[0].TxID != replacement.TxID {
+		t.Errorf("Pending after replacement = %d transactions, want only the replacement", len(pending))
+	}
+
+	// Chains of replacements are capped
+	for i := 2; i <= maxReplacements; i++ {
+		if replacement, err = bump(replacement, replacement.Fee+50000); err != nil {
+			t.Fatalf("Replacement %d error = %v", i, err)
+		}
+	}
+	var rejectErr *RejectError
+	if _, err := bump(replacement, replacement.Fee+50000); !errors.As(err, &rejectErr) || rejectErr.Reason != RejectReplacementLimit {
+		t.Errorf("Replacement %d error = %v, want %s", maxReplacements+1, err, RejectReplacementLimit)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// The libp2p identity of the node is an Ed25519 key kept in the data
+// directory, so the peer ID stays the same across restarts. The file holds
+// the key in libp2p's protobuf encoding and is readable by its owner only.
+const nodeKeyFile = "node.key"
+
+// ErrInvalidNodeKey is returned for a key file that does not hold a private key
+var ErrInvalidNodeKey = errors.New("invalid node key")
+
+// GenerateNodeKey creates a new Ed25519 node key
+func GenerateNodeKey() (crypto.PrivKey, error) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate node key: %w", err)
+	}
+	return priv, nil
+}
+
+// LoadOrCreateNodeKey loads the node key of dataDir, creating it on first run
+func LoadOrCreateNodeKey(dataDir string) (crypto.PrivKey, error) {
+	path := filepath.Join(dataDir, nodeKeyFile)
+	priv, err := readNodeKey(path)
+	if err == nil {
+		return priv, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	priv, err = GenerateNodeKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := SaveNodeKey(dataDir, priv); err != nil {
+		return nil, err
+	}
+	fmt.Printf("🔑 Created node key %s\n", path)
+	return priv, nil
+}
+
+// SaveNodeKey writes the node key of dataDir, replacing any existing key
+func SaveNodeKey(dataDir string, priv crypto.PrivKey) error {
+	data, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("failed to encode node key: %w", err)
+	}
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	// Write a temporary file first so a crash never leaves half a key
+	path := filepath.Join(dataDir, nodeKeyFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write node key: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write node key: %w", err)
+	}
+	return nil
+}
+
+// ImportNodeKey replaces the node key of dataDir with the key in file, which
+// must use the node key format
+func ImportNodeKey(dataDir, file string) (crypto.PrivKey, error) {
+	priv, err := readNodeKey(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := SaveNodeKey(dataDir, priv); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// readNodeKey reads a key file, tightening permissions that let anyone but
+// the owner read it
+func readNodeKey(path string) (crypto.PrivKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		fmt.Printf("⚠️ Node key %s is accessible by other users, restricting it to the owner\n", path)
+		if err := os.Chmod(path, 0o600); err != nil {
+			return nil, fmt.Errorf("failed to restrict node key permissions: %w", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read node key: %w", err)
+	}
+	priv, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidNodeKey, path, err)
+	}
+	return priv, nil
+}
+
+// runNodeKeyCommand implements "nodekey show|rotate|import <file>", which
+// manages the node key of a data directory while the node is stopped
+func runNodeKeyCommand(args []string) error {
+	fs := flag.NewFlagSet("nodekey", flag.ContinueOnError)
+	dataDir := fs.String("datadir", "", "Data directory (default data/<network>/node-<p2p port>)")
+	network := fs.String("network", DevNetParams.Name, "Built-in network preset, used for the default data directory")
+	p2pPort := fs.String("p2p", "6001", "P2P network port, used for the default data directory")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blockchain-mvp nodekey [flags] show|rotate|import <file>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dataDir == "" {
+		*dataDir = filepath.Join("data", *network, "node-"+*p2pPort)
+	}
+
+	var priv crypto.PrivKey
+	var err error
+	switch fs.Arg(0) {
+	case "show":
+		priv, err = LoadOrCreateNodeKey(*dataDir)
+	case "rotate":
+		if priv, err = GenerateNodeKey(); err == nil {
+			err = SaveNodeKey(*dataDir, priv)
+		}
+	case "import":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return errors.New("import needs a key file")
+		}
+		priv, err = ImportNodeKey(*dataDir, fs.Arg(1))
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown nodekey command %q", fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+	fmt.Printf("🔑 Node key: %s\n", filepath.Join(*dataDir, nodeKeyFile))
+	fmt.Printf("🆔 Peer ID:  %s\n", id)
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestWalletKeyPersists(t *testing.T) {
+	dir := t.TempDir()
+	wallet, err := LoadOrCreateWallet(dir)
+	if err != nil {
+		t.Fatalf("LoadOrCreateWallet() error = %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, walletKeyFile)); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Wallet key file = %v, %v, want mode 0600", info, err)
+	}
+
+	// Rewards paid to the address stay spendable after a restart
+	reloaded, err := LoadOrCreateWallet(dir)
+	if err != nil || reloaded.GetAddress() != wallet.GetAddress() || !reloaded.PrivateKey.Equal(wallet.PrivateKey) {
+		t.Fatalf("LoadOrCreateWallet() after a restart = %v, want the same key", err)
+	}
+}
+
+func TestNodeKeyPersists(t *testing.T) {
+	dir := t.TempDir()
+	priv, err := LoadOrCreateNodeKey(dir)
+	if err != nil {
+		t.Fatalf("LoadOrCreateNodeKey() error = %v", err)
+	}
+	path := filepath.Join(dir, nodeKeyFile)
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Node key file = %v, %v, want mode 0600", info, err)
+	}
+
+	// The peer ID survives a restart
+	reloaded, err := LoadOrCreateNodeKey(dir)
+	if err != nil || !reloaded.Equals(priv) {
+		t.Fatalf("LoadOrCreateNodeKey() after a restart = %v, want the same key", err)
+	}
+
+	// Loose permissions are tightened on load
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrCreateNodeKey(dir); err != nil {
+		t.Fatalf("LoadOrCreateNodeKey() error = %v", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("Node key mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// Rotating changes the peer ID, importing restores it
+	rotated, err := GenerateNodeKey()
+	if err != nil || SaveNodeKey(dir, rotated) != nil {
+		t.Fatalf("Failed to rotate node key: %v", err)
+	}
+	oldID, _ := peer.IDFromPrivateKey(priv)
+	newID, _ := peer.IDFromPrivateKey(rotated)
+	if oldID == newID {
+		t.Error("Rotated node key kept the peer ID")
+	}
+
+	backup := t.TempDir()
+	if err := SaveNodeKey(backup, priv); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportNodeKey(dir, filepath.Join(backup, nodeKeyFile))
+	if err != nil || !imported.Equals(priv) {
+		t.Fatalf("ImportNodeKey() error = %v", err)
+	}
+	if loaded, err := LoadOrCreateNodeKey(dir); err != nil || !loaded.Equals(priv) {
+		t.Errorf("Imported node key was not persisted: %v", err)
+	}
+
+	garbage := filepath.Join(backup, "garbage")
+	if err := os.WriteFile(garbage, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportNodeKey(dir, garbage); !errors.Is(err, ErrInvalidNodeKey) {
+		t.Errorf("ImportNodeKey() of garbage error = %v, want %v", err, ErrInvalidNodeKey)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Orphan pool limits
+const (
+	maxOrphanBlocks = 100
+	orphanExpiry    = 10 * time.Minute
+)
+
+// ErrOrphanBlock is returned when a block's parent is unknown. The block is
+// kept in the orphan pool and connected once the parent arrives.
+var ErrOrphanBlock = errors.New("orphan block: parent unknown")
+
+type orphanBlock struct {
+	block   Block
+	expires time.Time
+}
+
+// OrphanPool holds blocks whose parent is not in the block index yet, keyed
+// by parent hash. It is not safe for concurrent use.
+type OrphanPool struct {
+	orphans  map[string]*orphanBlock
+	byParent map[string][]string
+	now      func() time.Time
+}
+
+func NewOrphanPool() *OrphanPool {
+	return &OrphanPool{
+		orphans:  make(map[string]*orphanBlock),
+		byParent: make(map[string][]string),
+		now:      time.Now,
+	}
+}
+
+// Has reports whether a block is in the pool
+func (p *OrphanPool) Has(hash string) bool {
+	_, ok := p.orphans[hash]
+	return ok
+}
+
+// Len returns the number of orphans
+func (p *OrphanPool) Len() int {
+	return len(p.orphans)
+}
+
+// Add stores an orphan, evicting expired orphans and, if the pool is still
+// full, the orphan closest to expiry
+func (p *OrphanPool) Add(block Block) {
+	if p.Has(block.Hash) {
+		return
+	}
+
+	now := p.now()
+	for hash, orphan := range p.orphans {
+		if now.After(orphan.expires) {
+			p.remove(hash)
+		}
+	}
+	for len(p.orphans) >= maxOrphanBlocks {
+		var oldest *orphanBlock
+		for _, orphan := range p.orphans {
+			if oldest == nil || orphan.expires.Before(oldest.expires) {
+				oldest = orphan
+			}
+		}
+		p.remove(oldest.block.Hash)
+	}
+
+	p.orphans[block.Hash] = &orphanBlock{block: block, expires: now.Add(orphanExpiry)}
+	p.byParent[block.PrevHash] = append(p.byParent[block.PrevHash], block.Hash)
+}
+
+// TakeChildren removes and returns the orphans whose parent is hash
+func (p *OrphanPool) TakeChildren(hash string) []Block {
+	hashes := p.byParent[hash]
+	delete(p.byParent, hash)
+
+	children := make([]Block, 0, len(hashes))
+	for _, child := range hashes {
+		if orphan, ok := p.orphans[child]; ok {
+			children = append(children, orphan.block)
+			delete(p.orphans, child)
+		}
+	}
+	return children
+}
+
+// Root walks from an orphan up through orphaned ancestors and returns the
+// hash of the first missing block
+func (p *OrphanPool) Root(hash string) string {
+	orphan, ok := p.orphans[hash]
+	for ok {
+		hash = orphan.block.PrevHash
+		orphan, ok = p.orphans[hash]
+	}
+	return hash
+}
+
+func (p *OrphanPool) remove(hash string) {
+	orphan, ok := p.orphans[hash]
+	if !ok {
+		return
+	}
+	delete(p.orphans, hash)
+
+	siblings := p.byParent[orphan.block.PrevHash]
+	for i, sibling := range siblings {
+		if sibling == hash {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(p.byParent, orphan.block.PrevHash)
+	} else {
+		p.byParent[orphan.block.PrevHash] = siblings
+	}
+}
+
+// connectOrphans connects the orphans descending from a newly added block,
+// breadth first. Callers must hold chainMutex.
+func (s *BlockchainState) connectOrphans(hash string) []ReorgEvent {
+	var events []ReorgEvent
+	queue := []string{hash}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+
+		for _, child := range s.orphans.TakeChildren(parent) {
+			event, err := s.addBlock(child)
+			if event != nil {
+				events = append(events, *event)
+			}
+			if err != nil {
+				fmt.Printf("❌ Dropping orphan block %d: %v\n", child.Index, err)
+				continue
+			}
+			queue = append(queue, child.Hash)
+		}
+	}
+	return events
+}
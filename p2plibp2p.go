@@ -3,13 +3,13 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	libp2p "github.com/libp2p/go-libp2p"
 
+	coreconnmgr "github.com/libp2p/go-libp2p/core/connmgr"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -24,7 +24,8 @@ const DiscoveryServiceTag = "blockchain-discovery"
 
 // Notifee implements the mdns.Notifee interface for peer discovery.
 type Notifee struct {
-	h host.Host
+	h     host.Host
+	state *BlockchainState
 }
 
 func (n *Notifee) HandlePeerFound(pi peer.AddrInfo) {
@@ -33,69 +34,55 @@ func (n *Notifee) HandlePeerFound(pi peer.AddrInfo) {
 	}
 
 	fmt.Printf("🎯 Peer Discovered: %s\n", pi.ID)
+	connectPeer(n.h, n.state, pi)
+}
+
+// connectPeer connects to a peer and handshakes with it, unless a handshake
+// with it is already on record. A peer that passes the handshake is added to
+// the address book, and synced from if it is ahead.
+func connectPeer(h host.Host, state *BlockchainState, pi peer.AddrInfo) error {
+	if _, ok := state.GetPeers().Get(pi.ID); ok && h.Network().Connectedness(pi.ID) == network.Connected {
+		recordPeer(state, pi)
+		return nil
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
-	if err := n.h.Connect(ctx, pi); err != nil {
+	if err := h.Connect(ctx, pi); err != nil {
 		fmt.Printf("❌ Failed to connect to peer %s: %v\n", pi.ID, err)
-		return
+		return err
 	}
 
 	fmt.Printf("🔗 Successfully connected to peer: %s\n", pi.ID)
 
-	// Open stream with retry
-	var stream network.Stream
-	var err error
-	for i := 0; i < 3; i++ {
-		stream, err = n.h.NewStream(ctx, pi.ID, protocolID)
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Second)
-	}
-	if err != nil {
-		fmt.Printf("❌ Failed to open stream after retries: %v\n", err)
-		return
-	}
-	defer stream.Close()
-
-	// Send hello message
-	message := fmt.Sprintf("Hello from %s!", n.h.ID())
-	if _, err := stream.Write([]byte(message)); err != nil {
-		fmt.Printf("❌ Failed to send hello: %v\n", err)
-		return
-	}
-}
-
-// Add helper methods for stream handling
-func (n *Notifee) tryOpenStream(peerID peer.ID) (network.Stream, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-
-	stream, err := n.h.NewStream(ctx, peerID, protocolID)
+	remote, err := PerformHandshake(h, state, pi.ID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open stream: %w", err)
+		fmt.Printf("❌ Handshake with %s failed: %v\n", pi.ID, err)
+		h.Network().ClosePeer(pi.ID)
+		return err
 	}
-	return stream, nil
+	recordPeer(state, pi)
+	go syncIfAhead(h, state, pi.ID, remote)
+	return nil
 }
 
-func (n *Notifee) sendHello(stream network.Stream) error {
-	message := fmt.Sprintf("Hello from %s!", n.h.ID().String())
-	_, err := stream.Write([]byte(message))
-	if err != nil {
-		return fmt.Errorf("failed to send hello: %w", err)
+// recordPeer adds a peer the node has a handshake with to the address book,
+// if the node keeps one
+func recordPeer(state *BlockchainState, pi peer.AddrInfo) {
+	if book := state.GetAddressBook(); book != nil {
+		book.Add(pi)
 	}
-	return nil
 }
 
-// SetupDiscovery starts mDNS discovery service.
-func SetupDiscovery(h host.Host) error {
+// SetupDiscovery starts mDNS discovery service. Every peer found is
+// connected to and handshaken with, see PerformHandshake.
+func SetupDiscovery(h host.Host, state *BlockchainState) error {
 	// Create a new discovery service
 	discovery := mdns.NewMdnsService(
 		h,
 		DiscoveryServiceTag,
-		&Notifee{h: h},
+		&Notifee{h: h, state: state},
 	)
 
 	if discovery == nil {
@@ -111,83 +98,233 @@ func SetupDiscovery(h host.Host) error {
 	return nil
 }
 
-// SetupStreamHandler registers a handler for incoming streams on our protocol.
+// SetupStreamHandler answers handshakes on protocolID. A peer on another
+// network or speaking an incompatible version is disconnected; the
+// handshake of any other peer is kept in the state's PeerSet, and peers gone
+// from the network are forgotten.
 func SetupStreamHandler(h host.Host, state *BlockchainState) {
 	h.SetStreamHandler(protocolID, func(s network.Stream) {
-		// Read the hello message first
-		buf := make([]byte, 1024)
-		n, err := s.Read(buf)
+		defer s.Close()
+		from := s.Conn().RemotePeer()
+
+		remote, err := readHandshake(s)
 		if err != nil {
-			fmt.Printf("❌ Error reading hello message: %v\n", err)
+			fmt.Printf("❌ Bad handshake from %s: %v\n", from, err)
+			penalizePeer(h, state, from, framePenalty(err), "bad handshake")
 			s.Reset()
+			h.Network().ClosePeer(from)
 			return
 		}
 
-		helloMsg := string(buf[:n])
-		fmt.Printf("📨 Received: %s\n", helloMsg)
-
-		// Now handle blockchain sync
-		var receivedChain []Block
-		decoder := json.NewDecoder(s)
-		if err := decoder.Decode(&receivedChain); err != nil {
-			// This might not be a chain sync message, that's okay
+		local := state.LocalHandshake()
+		if err := writeMessage(s, Message{Type: MsgVersion, Payload: EncodeHandshake(local)}); err != nil {
+			fmt.Printf("❌ Error sending handshake to %s: %v\n", from, err)
 			return
 		}
-
-		consensus := state.GetConsensus()
-		if consensus.HandleChainSync(receivedChain) {
-			fmt.Println("✅ Chain updated successfully")
+		if err := acceptHandshake(state, from, local, remote); err != nil {
+			fmt.Printf("❌ Handshake with %s failed: %v\n", from, err)
+			h.Network().ClosePeer(from)
+			return
 		}
+		go syncIfAhead(h, state, from, remote)
+	})
 
-		s.Close()
+	h.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			if n.Connectedness(c.RemotePeer()) != network.Connected {
+				state.GetPeers().Remove(c.RemotePeer())
+			}
+		},
 	})
 }
 
-// BroadcastBlockchain sends the current blockchain to all connected peers.
-//
-//	func BroadcastBlockchain(h host.Host, blockchain []Block) {
-//		peers := h.Network().Peers()
-//		fmt.Println("Broadcasting blockchain to", len(peers), "peers.")
-//		for _, p := range peers {
-//			s, err := h.NewStream(context.Background(), p, protocolID)
-//			if err != nil {
-//				fmt.Println("Error opening stream to peer", p.String(), ":", err)
-//				continue
-//			}
-//			encoder := json.NewEncoder(s)
-//			if err := encoder.Encode(blockchain); err != nil {
-//				fmt.Println("Error sending blockchain to peer", p.String(), ":", err)
-//			}
-//			s.Close()
-//		}
-//	}
-func BroadcastBlockchain(h host.Host, blockchain []Block) {
-	peers := h.Network().Peers()
-	fmt.Println("Broadcasting blockchain to", len(peers), "peers.")
-	for _, p := range peers {
-		s, err := h.NewStream(context.Background(), p, protocolID)
+// PerformHandshake exchanges handshakes with a newly connected peer and
+// records the peer's if it is compatible
+func PerformHandshake(h host.Host, state *BlockchainState, id peer.ID) (Handshake, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, err := h.NewStream(ctx, id, protocolID)
+	if err != nil {
+		return Handshake{}, err
+	}
+	defer s.Close()
+
+	local := state.LocalHandshake()
+	if err := writeMessage(s, Message{Type: MsgVersion, Payload: EncodeHandshake(local)}); err != nil {
+		return Handshake{}, err
+	}
+	remote, err := readHandshake(s)
+	if err != nil {
+		return Handshake{}, err
+	}
+	return remote, acceptHandshake(state, id, local, remote)
+}
+
+// readHandshake reads a version message from a stream
+func readHandshake(s network.Stream) (Handshake, error) {
+	msg, err := readMessage(s)
+	if err != nil {
+		return Handshake{}, err
+	}
+	if msg.Type != MsgVersion {
+		return Handshake{}, fmt.Errorf("expected a handshake, got %s", msg.Type)
+	}
+	return DecodeHandshake(msg.Payload)
+}
+
+// acceptHandshake checks a peer's handshake and records it
+func acceptHandshake(state *BlockchainState, id peer.ID, local, remote Handshake) error {
+	if err := CheckHandshake(local, remote); err != nil {
+		return err
+	}
+	state.GetPeers().Add(id, remote)
+	fmt.Printf("🤝 Handshake with %s: version %d, height %d\n", id, remote.Version, remote.BestHeight)
+	return nil
+}
+
+// syncIfAhead syncs headers first from a peer whose handshake claims more
+// chain work than ours
+func syncIfAhead(h host.Host, state *BlockchainState, id peer.ID, remote Handshake) {
+	if !remote.HasFeature(FeatureHeaders) ||
+		ParseChainWork(remote.ChainWork).Cmp(ParseChainWork(state.GetLastBlock().ChainWork)) <= 0 {
+		return
+	}
+	if sm := state.GetSyncManager(); sm != nil {
+		sm.Trigger()
+	}
+}
+
+// SetupBlockHandler handles block announcements and serves blocks by hash
+// and header chains on BlockProtocol, so peers can fetch the missing
+// ancestors of an orphan block and sync headers first.
+func SetupBlockHandler(h host.Host, state *BlockchainState) {
+	h.SetStreamHandler(BlockProtocol, func(s network.Stream) {
+		defer s.Close()
+		from := s.Conn().RemotePeer()
+
+		msg, err := readMessage(s)
 		if err != nil {
-			fmt.Println("Error opening stream to peer", p.String(), ":", err)
-			continue
+			fmt.Printf("❌ Error reading block request from %s: %v\n", from, err)
+			penalizePeer(h, state, from, framePenalty(err), "bad frame")
+			s.Reset()
+			return
+		}
+
+		var reply Message
+		switch msg.Type {
+		case MsgBlock:
+			block, err := DecodeBlock(msg.Payload)
+			if err != nil {
+				fmt.Printf("❌ Bad block from %s: %v\n", from, err)
+				penalizePeer(h, state, from, PenaltyMalformedMessage, "undecodable block")
+				return
+			}
+			handleBlockAnnouncement(h, state, block, from)
+			return
+		case MsgGetBlock:
+			hash := string(msg.Payload)
+			reply = Message{Type: MsgNotFound, Payload: msg.Payload}
+			if block, ok := state.GetBlockByHash(hash); ok {
+				reply = Message{Type: MsgBlock, Payload: EncodeBlock(block)}
+			}
+		case MsgGetHeaders:
+			locator, err := decodeHashes(msg.Payload)
+			if err != nil {
+				fmt.Printf("❌ Bad header request from %s: %v\n", from, err)
+				penalizePeer(h, state, from, PenaltyMalformedMessage, "undecodable locator")
+				s.Reset()
+				return
+			}
+
+			headers := state.HeadersAfter(locator, maxHeadersPerMessage)
+			reply = Message{Type: MsgHeaders, Payload: encodeHeaders(headers)}
+		default:
+			fmt.Printf("⚠️ Unexpected %s message from %s on %s\n", msg.Type, from, BlockProtocol)
+			penalizePeer(h, state, from, PenaltyUnsolicited, "unexpected "+msg.Type.String())
+			s.Reset()
+			return
 		}
-		encoder := json.NewEncoder(s)
-		if err := encoder.Encode(blockchain); err != nil {
-			fmt.Println("Error sending blockchain to peer", p.String(), ":", err)
-		} else {
-			fmt.Printf("Blockchain sent to peer %s\n", p.String())
+
+		if err := writeMessage(s, reply); err != nil {
+			fmt.Printf("❌ Error replying to %s from %s: %v\n", msg.Type, from, err)
 		}
-		s.Close()
+	})
+}
+
+// fetchBlock downloads a block by hash from a peer
+func fetchBlock(h host.Host, from peer.ID, hash string) (Block, error) {
+	reply, err := request(h, from, BlockProtocol, Message{Type: MsgGetBlock, Payload: []byte(hash)})
+	if err != nil {
+		return Block{}, err
+	}
+	if reply.Type != MsgBlock {
+		return Block{}, fmt.Errorf("peer does not have block %s", hash)
+	}
+
+	block, err := DecodeBlock(reply.Payload)
+	if err != nil {
+		return Block{}, fmt.Errorf("bad reply for block %s: %w", hash, err)
 	}
+	if block.Hash != hash {
+		return Block{}, fmt.Errorf("bad reply for block %s: got block %s", hash, block.Hash)
+	}
+	return block, nil
 }
 
-// CreateLibp2pHost creates a new libp2p host.
-func CreateLibp2pHost(port string) (host.Host, error) {
-	// Generate new private key
-	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.Ed25519, 2048, rand.Reader)
+// fetchHeaders downloads the headers a peer has after locator
+func fetchHeaders(h host.Host, from peer.ID, locator []string) ([]BlockHeader, error) {
+	reply, err := request(h, from, BlockProtocol, Message{Type: MsgGetHeaders, Payload: encodeHashes(locator)})
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != MsgHeaders {
+		return nil, fmt.Errorf("unexpected reply %s to getheaders", reply.Type)
+	}
+
+	headers, err := decodeHeaders(reply.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("bad headers reply: %w", err)
+	}
+	if len(headers) > maxHeadersPerMessage {
+		return nil, fmt.Errorf("peer sent %d headers, more than %d", len(headers), maxHeadersPerMessage)
+	}
+	return headers, nil
+}
+
+// RequestMissingBlock fetches a missing block and its missing ancestors from
+// a peer. A peer serving inventories sends the whole branch from the last
+// block we share up to hash with getblocks and getdata. Otherwise, or if hash
+// is not on the peer's main chain, the block is fetched alone, and if it is
+// an orphan too, adding it requests its parent in turn, walking back until
+// the blocks connect.
+func RequestMissingBlock(h host.Host, state *BlockchainState, from peer.ID, hash string) {
+	if info, ok := state.GetPeers().Get(from); ok && info.HasFeature(FeatureInventory) {
+		if err := SyncBlocks(h, state, from, hash); err != nil {
+			fmt.Printf("❌ Failed to sync blocks up to %s from %s: %v\n", hash, from, err)
+		}
+		if _, ok := state.GetBlockByHash(hash); ok {
+			return
+		}
+	}
+
+	block, err := fetchBlock(h, from, hash)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate key pair: %w", err)
+		fmt.Printf("❌ Failed to fetch block %s from %s: %v\n", hash, from, err)
+		return
 	}
 
+	err = state.AddBlockFromPeer(block, from)
+	if err != nil && !errors.Is(err, ErrOrphanBlock) && !errors.Is(err, ErrDuplicateBlock) {
+		fmt.Printf("❌ Rejected block %s from %s: %v\n", hash, from, err)
+		penalizePeer(h, state, from, PenaltyInvalidBlock, "invalid block")
+	}
+}
+
+// CreateLibp2pHost creates a new libp2p host with the identity priv, see
+// LoadOrCreateNodeKey. The gater, if not nil, can refuse connections, see
+// BanManager.
+func CreateLibp2pHost(port string, priv crypto.PrivKey, gater coreconnmgr.ConnectionGater) (host.Host, error) {
 	// Create multiaddress
 	addr := fmt.Sprintf("/ip4/0.0.0.0/tcp/%s", port)
 	ma, err := multiaddr.NewMultiaddr(addr)
@@ -206,7 +343,7 @@ func CreateLibp2pHost(port string) (host.Host, error) {
 	}
 
 	// Create libp2p host with the connection manager
-	h, err := libp2p.New(
+	opts := []libp2p.Option{
 		libp2p.ListenAddrs(ma),
 		libp2p.Identity(priv),
 		libp2p.DefaultTransports,
@@ -215,7 +352,11 @@ func CreateLibp2pHost(port string) (host.Host, error) {
 		libp2p.NATPortMap(),
 		libp2p.DisableRelay(),
 		libp2p.ConnectionManager(connManager),
-	)
+	}
+	if gater != nil {
+		opts = append(opts, libp2p.ConnectionGater(gater))
+	}
+	h, err := libp2p.New(opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create host: %w", err)
 	}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+// NetworkParams holds the constants every node on a network must agree on.
+// Two nodes only derive the same genesis hash if their params are identical.
+type NetworkParams struct {
+	Name               string              `json:"name"`
+	ChainID            string              `json:"chainId"`
+	AddressVersion     byte                `json:"addressVersion"`
+	GenesisTimestamp   int64               `json:"genesisTimestamp"`
+	GenesisNonce       int                 `json:"genesisNonce"`
+	GenesisBits        uint32              `json:"genesisBits"`
+	GenesisAllocations []GenesisAllocation `json:"genesisAllocations"`
+	BlockSubsidy       Amount              `json:"blockSubsidy"`
+	CoinbaseMaturity   int                 `json:"coinbaseMaturity"`
+	PowLimitBits       uint32              `json:"powLimitBits"`     // Easiest allowed target
+	TargetBlockTime    int64               `json:"targetBlockTime"`  // Seconds between blocks
+	RetargetInterval   int                 `json:"retargetInterval"` // Blocks between retargets
+}
+
+// GenesisAllocation credits an address with coins in the genesis block
+type GenesisAllocation struct {
+	Address string `json:"address"`
+	Amount  Amount `json:"amount"`
+}
+
+// Built-in network presets
+var (
+	MainNetParams = NetworkParams{
+		Name:             "mainnet",
+		ChainID:          "layla-main-1",
+		AddressVersion:   0x00,
+		GenesisTimestamp: 1735689600, // 2025-01-01T00:00:00Z
+		GenesisNonce:     0,
+		GenesisBits:      0x1f00ffff,
+		BlockSubsidy:     Coins(50),
+		CoinbaseMaturity: 100,
+		PowLimitBits:     0x1f00ffff,
+		TargetBlockTime:  60,
+		RetargetInterval: 60,
+	}
+
+	TestNetParams = NetworkParams{
+		Name:             "testnet",
+		ChainID:          "layla-test-1",
+		AddressVersion:   0x6f,
+		GenesisTimestamp: 1735776000, // 2025-01-02T00:00:00Z
+		GenesisNonce:     0,
+		GenesisBits:      0x1f0fffff,
+		BlockSubsidy:     Coins(50),
+		CoinbaseMaturity: 20,
+		PowLimitBits:     0x1f0fffff,
+		TargetBlockTime:  30,
+		RetargetInterval: 30,
+	}
+
+	DevNetParams = NetworkParams{
+		Name:             "devnet",
+		ChainID:          "layla-dev-1",
+		AddressVersion:   0x1e,
+		GenesisTimestamp: 1735862400, // 2025-01-03T00:00:00Z
+		GenesisNonce:     0,
+		GenesisBits:      0x200fffff,
+		BlockSubsidy:     Coins(50),
+		CoinbaseMaturity: 2,
+		PowLimitBits:     0x207fffff,
+		TargetBlockTime:  10,
+		RetargetInterval: 10,
+	}
+)
+
+var networkPresets = map[string]*NetworkParams{
+	MainNetParams.Name: &MainNetParams,
+	TestNetParams.Name: &TestNetParams,
+	DevNetParams.Name:  &DevNetParams,
+}
+
+// activeParams are the params of the network this node participates in
+var activeParams = &DevNetParams
+
+// ActiveNetwork returns the params of the network the node is running on
+func ActiveNetwork() *NetworkParams {
+	return activeParams
+}
+
+// SetActiveNetwork switches the node to another network. It must be called
+// before any block or address is created.
+func SetActiveNetwork(params *NetworkParams) {
+	activeParams = params
+}
+
+// NetworkPreset returns a built-in network by name
+func NetworkPreset(name string) (*NetworkParams, error) {
+	params, ok := networkPresets[name]
+	if !ok {
+		names := make([]string, 0, len(networkPresets))
+		for n := range networkPresets {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown network %q (known: %v)", name, names)
+	}
+	return params, nil
+}
+
+// LoadNetworkParams reads network params from a JSON file
+func LoadNetworkParams(path string) (*NetworkParams, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network params: %w", err)
+	}
+
+	var params NetworkParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, fmt.Errorf("failed to parse network params %s: %w", path, err)
+	}
+
+	if err := params.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid network params %s: %w", path, err)
+	}
+	return &params, nil
+}
+
+// Validate checks the params are internally consistent
+func (p *NetworkParams) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if p.ChainID == "" {
+		return fmt.Errorf("chainId is required")
+	}
+	if CompactToBig(p.PowLimitBits).Sign() <= 0 {
+		return fmt.Errorf("powLimitBits must encode a positive target")
+	}
+	if target := CompactToBig(p.GenesisBits); target.Sign() <= 0 || target.Cmp(CompactToBig(p.PowLimitBits)) > 0 {
+		return fmt.Errorf("genesisBits must encode a positive target within powLimitBits")
+	}
+	if p.TargetBlockTime <= 0 {
+		return fmt.Errorf("targetBlockTime must be positive")
+	}
+	if p.RetargetInterval <= 0 {
+		return fmt.Errorf("retargetInterval must be positive")
+	}
+	if !p.BlockSubsidy.IsValid() {
+		return fmt.Errorf("blockSubsidy must be between 0 and %s", MaxMoney)
+	}
+	if p.CoinbaseMaturity < 0 {
+		return fmt.Errorf("coinbaseMaturity must not be negative")
+	}
+
+	for i, alloc := range p.GenesisAllocations {
+		if err := validateAddressVersion(alloc.Address, p.AddressVersion); err != nil {
+			return fmt.Errorf("genesis allocation %d: %w", i, err)
+		}
+		if alloc.Amount <= 0 {
+			return fmt.Errorf("genesis allocation %d: amount must be positive", i)
+		}
+	}
+	if _, err := p.genesisSupply(); err != nil {
+		return fmt.Errorf("genesis allocations: %w", err)
+	}
+	return nil
+}
+
+// genesisSupply returns the total of the genesis allocations
+func (p *NetworkParams) genesisSupply() (Amount, error) {
+	amounts := make([]Amount, len(p.GenesisAllocations))
+	for i, alloc := range p.GenesisAllocations {
+		amounts[i] = alloc.Amount
+	}
+	return SumAmounts(amounts...)
+}
+
+// BlockSubsidyAt returns the subsidy of the block at height. Every block
+// pays BlockSubsidy until the genesis allocations plus all subsidies reach
+// MaxMoney; after that the subsidy is whatever is left, then zero.
+func (p *NetworkParams) BlockSubsidyAt(height int) Amount {
+	if height <= 0 || p.BlockSubsidy <= 0 {
+		return 0
+	}
+	supply, err := p.genesisSupply()
+	if err != nil {
+		return 0
+	}
+
+	remaining := MaxMoney - supply
+	fullBlocks := int64(remaining / p.BlockSubsidy)
+	switch prior := int64(height - 1); {
+	case prior < fullBlocks:
+		return p.BlockSubsidy
+	case prior == fullBlocks:
+		return remaining - Amount(fullBlocks)*p.BlockSubsidy
+	default:
+		return 0
+	}
+}
+
+// GenesisHash returns the hash of the genesis block derived from the params
+func (p *NetworkParams) GenesisHash() string {
+	return buildGenesisBlock(p).Hash
+}
+
+// ValidateAddress checks an address is well formed for the active network
+func ValidateAddress(address string) error {
+	return validateAddressVersion(address, activeParams.AddressVersion)
+}
+
+func validateAddressVersion(address string, version byte) error {
+	decoded := base58.Decode(address)
+	if len(decoded) != 25 {
+		return fmt.Errorf("invalid address length for %q", address)
+	}
+
+	if decoded[0] != version {
+		return fmt.Errorf("address %q has version 0x%02x, network expects 0x%02x",
+			address, decoded[0], version)
+	}
+
+	firstHash := sha256.Sum256(decoded[:21])
+	secondHash := sha256.Sum256(firstHash[:])
+	for i := 0; i < 4; i++ {
+		if decoded[21+i] != secondHash[i] {
+			return fmt.Errorf("invalid checksum for address %q", address)
+		}
+	}
+	return nil
+}
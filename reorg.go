@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrDuplicateBlock is returned when a block is already in the block index
+var ErrDuplicateBlock = errors.New("block already known")
+
+// ReorgEvent describes a change of the main chain. A switch to another
+// branch removes blocks; a block extending the tip only adds one.
+type ReorgEvent struct {
+	Removed []Block // Disconnected blocks, old tip first
+	Added   []Block // Connected blocks, fork point child first
+}
+
+// SubscribeReorg registers a handler called after every reorganization
+func (s *BlockchainState) SubscribeReorg(handler func(ReorgEvent)) {
+	s.chainMutex.Lock()
+	defer s.chainMutex.Unlock()
+	s.reorgHandlers = append(s.reorgHandlers, handler)
+}
+
+// SubscribeChain registers a handler called after every change of the main
+// chain, including blocks that simply extend the tip
+func (s *BlockchainState) SubscribeChain(handler func(ReorgEvent)) {
+	s.chainMutex.Lock()
+	defer s.chainMutex.Unlock()
+	s.chainHandlers = append(s.chainHandlers, handler)
+}
+
+// tipNode returns the index node of the main-chain tip, or nil for an empty
+// chain. Callers must hold chainMutex.
+func (s *BlockchainState) tipNode() *blockNode {
+	if len(s.chain) == 0 {
+		return nil
+	}
+	return s.index.Lookup(s.chain[len(s.chain)-1].Hash)
+}
+
+// isOnMainChain reports whether node is part of the main chain. Callers must
+// hold chainMutex.
+func (s *BlockchainState) isOnMainChain(node *blockNode) bool {
+	height := node.height()
+	return height < len(s.chain) && s.chain[height].Hash == node.block.Hash
+}
+
+// ancestry returns the blocks from genesis up to and including node, which
+// may be on a side branch. Callers must hold chainMutex.
+func (s *BlockchainState) ancestry(node *blockNode) []Block {
+	var branch []Block
+	for !s.isOnMainChain(node) {
+		branch = append(branch, node.block)
+		node = node.parent
+	}
+
+	forkHeight := node.height() + 1
+	if len(branch) == 0 {
+		return s.chain[:forkHeight:forkHeight]
+	}
+
+	chain := make([]Block, 0, forkHeight+len(branch))
+	chain = append(chain, s.chain[:forkHeight]...)
+	for i := len(branch) - 1; i >= 0; i-- {
+		chain = append(chain, branch[i])
+	}
+	return chain
+}
+
+// connectBlock connects a block extending the tip to the UTXO set and the
+// main chain. Callers must hold chainMutex.
+func (s *BlockchainState) connectBlock(node *blockNode) error {
+	undo, err := s.utxos.ConnectBlock(node.block)
+	if err != nil {
+		return fmt.Errorf("invalid block: %w", err)
+	}
+
+	if err := s.persistBlock(node.block); err != nil {
+		s.utxos.DisconnectBlock(node.block, undo)
+		return err
+	}
+	s.undo[node.block.Hash] = undo
+	s.chain = append(s.chain, node.block)
+	return nil
+}
+
+// reorganize makes newTip the main-chain tip. Blocks back to the fork point
+// are disconnected using their undo records, then the new branch is
+// connected. If a branch block turns out to be invalid, it and its
+// descendants are dropped from the index and the store. The valid part of the
+// branch is kept if it still carries more work than the old chain, which is
+// restored otherwise; either way the invalid block's error is returned,
+// together with the event of a partial reorg. Callers must hold chainMutex.
+func (s *BlockchainState) reorganize(newTip *blockNode) (*ReorgEvent, error) {
+	var branch []*blockNode
+	fork := newTip
+	for !s.isOnMainChain(fork) {
+		branch = append([]*blockNode{fork}, branch...)
+		fork = fork.parent
+	}
+	fmt.Printf("🔀 Reorganizing: fork at block %d, %d blocks out, %d blocks in\n",
+		fork.height(), len(s.chain)-1-fork.height(), len(branch))
+
+	event := &ReorgEvent{}
+	rollback := func() {
+		for i := len(event.Added) - 1; i >= 0; i-- {
+			block := event.Added[i]
+			s.utxos.DisconnectBlock(block, s.undo[block.Hash])
+		}
+		for i := len(event.Removed) - 1; i >= 0; i-- {
+			s.utxos.ConnectBlock(event.Removed[i])
+		}
+	}
+
+	for i := len(s.chain) - 1; i > fork.height(); i-- {
+		block := s.chain[i]
+		if err := s.utxos.DisconnectBlock(block, s.undo[block.Hash]); err != nil {
+			rollback()
+			return nil, fmt.Errorf("failed to disconnect block %d: %w", block.Index, err)
+		}
+		event.Removed = append(event.Removed, block)
+	}
+
+	var invalid error
+	for _, node := range branch {
+		undo, err := s.utxos.ConnectBlock(node.block)
+		if err != nil {
+			s.discardBlocks(s.index.Remove(node.block.Hash))
+			invalid = fmt.Errorf("invalid block: block %d of the new branch: %w", node.height(), err)
+			if len(event.Added) == 0 || !node.parent.isBetterThan(s.tipNode()) {
+				rollback()
+				return nil, invalid
+			}
+			fmt.Printf("⚠️ Block %d of the new branch is invalid, keeping the valid part before it\n", node.height())
+			break
+		}
+		s.undo[node.block.Hash] = undo
+		event.Added = append(event.Added, node.block)
+	}
+
+	// Build a new slice so chains handed out by GetChain stay untouched
+	chain := make([]Block, 0, fork.height()+1+len(event.Added))
+	chain = append(chain, s.chain[:fork.height()+1]...)
+	chain = append(chain, event.Added...)
+
+	if s.db != nil {
+		if err := s.db.SaveChain(chain); err != nil {
+			rollback()
+			return nil, fmt.Errorf("failed to persist chain: %w", err)
+		}
+	}
+	s.chain = chain
+
+	fmt.Printf("✅ Reorganized to block %d\n", len(chain)-1)
+	return event, invalid
+}
+
+// discardBlocks deletes invalid side-branch blocks from the store, so they
+// are not indexed again when the chain is loaded
+func (s *BlockchainState) discardBlocks(hashes []string) {
+	if s.db == nil {
+		return
+	}
+	if err := s.db.DeleteBlocks(hashes); err != nil {
+		fmt.Printf("⚠️ Failed to delete %d invalid blocks from the store: %v\n", len(hashes), err)
+	}
+}
+
+// updateMempool keeps the mempool in step with the main chain. Transactions
+// of connected blocks and pending transactions conflicting with them leave
+// the pool, transactions of disconnected blocks return to it, and what
+// remains is checked again against the new tip.
+func (s *BlockchainState) updateMempool(event ReorgEvent) {
+	for _, block := range event.Added {
+		s.mempool.BlockConnected(block)
+	}
+	s.readmitTransactions(event)
+	s.mempool.Revalidate()
+}
+
+// readmitTransactions returns the transactions of disconnected blocks that
+// the new branch did not include to the mempool. Transactions the new branch
+// invalidated are dropped.
+func (s *BlockchainState) readmitTransactions(event ReorgEvent) {
+	included := make(map[string]bool)
+	for _, block := range event.Added {
+		for _, tx := range block.Transactions {
+			included[tx.TxID] = true
+		}
+	}
+
+	for i := len(event.Removed) - 1; i >= 0; i-- {
+		for _, tx := range event.Removed[i].Transactions {
+			if tx.IsCoinbase() || included[tx.TxID] {
+				continue
+			}
+			if err := s.AddTransaction(tx); err != nil {
+				fmt.Printf("🗑️ Dropping transaction %s after reorg: %v\n", tx.TxID, err)
+			}
+		}
+	}
+}
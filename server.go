@@ -2,14 +2,52 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type Server struct {
 	// blockchain *Blockchain
 	state *BlockchainState
+
+	// walletMutex is held from coin selection until the transaction is in
+	// the mempool, so concurrent requests never pick the same outputs
+	walletMutex sync.Mutex
+}
+
+// TransactionRequest asks the node wallet to pay Amount to Receiver. Without
+// a Fee the wallet pays the estimated fee rate for confirmation within
+// ConfTarget blocks, by default defaultConfirmTarget.
+type TransactionRequest struct {
+	Receiver   string
+	Amount     Amount
+	Fee        Amount
+	ConfTarget int `json:",omitempty"`
+}
+
+// BumpFeeRequest asks the node wallet to replace one of its pending
+// transactions with one paying Fee, by default twice the old fee
+type BumpFeeRequest struct {
+	TxID string
+	Fee  Amount
+}
+
+// RejectResponse explains why the mempool refused a transaction
+type RejectResponse struct {
+	Error  string       `json:"error"`
+	Reason RejectReason `json:"reason"`
+	MinFee FeeRate      `json:"minFeeRate,omitempty"` // Per 1000 bytes, for fee rejections
+}
+
+// BalanceResponse lists the unspent outputs of an address
+type BalanceResponse struct {
+	Address string `json:"address"`
+	Balance Amount `json:"balance"`
+	UTXOs   []UTXO `json:"utxos"`
 }
 
 func NewServer(state *BlockchainState) *Server {
@@ -39,34 +77,133 @@ func (s *Server) createTransaction(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
-	var tx Transaction
-	if err := json.NewDecoder(r.Body).Decode(&tx); err != nil {
+	var req TransactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid transaction data", http.StatusBadRequest)
 		return
 	}
 
-	// Generate TxID if not present
-	if tx.TxID == "" {
-		tx.TxID = CalculateTxID(tx)
+	// Fund the transaction from the outputs the wallet can still spend
+	s.walletMutex.Lock()
+	defer s.walletMutex.Unlock()
+	wallet := s.state.GetWallet()
+	utxos := s.state.GetSpendableUTXOs(wallet.GetAddress())
+
+	var tx Transaction
+	var err error
+	if req.Fee != 0 {
+		tx, err = wallet.CreateTransaction(utxos, req.Receiver, req.Amount, req.Fee)
+	} else {
+		target, targetErr := confirmTarget(req.ConfTarget)
+		if targetErr != nil {
+			http.Error(w, targetErr.Error(), http.StatusBadRequest)
+			return
+		}
+		tx, err = wallet.CreateTransactionAtRate(utxos, req.Receiver, req.Amount, s.state.EstimateFee(target).FeeRate)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Validate and sign transaction using state wallet
-	if err := s.state.GetWallet().SignTransaction(&tx); err != nil {
+	// Sign transaction using state wallet
+	if err := wallet.SignTransaction(&tx); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to sign transaction: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	if err := s.state.AddTransaction(tx); err != nil {
+		writeRejection(w, err)
+		return
+	}
+	AnnounceTransaction(s.state.GetP2PHost(), s.state, tx, "")
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tx)
+}
+
+// POST /transaction/bumpfee - Replace a pending wallet transaction with one
+// paying a higher fee
+func (s *Server) bumpFee(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req BumpFeeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid bump fee request", http.StatusBadRequest)
+		return
+	}
+	s.walletMutex.Lock()
+	defer s.walletMutex.Unlock()
+	pending, ok := s.state.GetPendingTransaction(req.TxID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Transaction %s is not pending", req.TxID), http.StatusNotFound)
+		return
+	}
+
+	fee := req.Fee
+	if fee == 0 {
+		fee = 2 * pending.Fee
+		if least := pending.Fee + mempoolFeeIncrement.Fee(len(EncodeTransaction(pending))); fee < least {
+			fee = least
+		}
+	}
+	wallet := s.state.GetWallet()
+	tx, err := wallet.BumpFee(pending, fee)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := wallet.SignTransaction(&tx); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to sign transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.state.AddTransaction(tx); err != nil {
+		writeRejection(w, err)
+		return
+	}
+	AnnounceTransaction(s.state.GetP2PHost(), s.state, tx, "")
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(tx)
 }
 
-// GET /mine - Mine a new block
-func (s *Server) mineBlock(w http.ResponseWriter, r *http.Request) {
+// rejectStatus maps mempool rejections to HTTP status codes
+var rejectStatus = map[RejectReason]int{
+	RejectInvalid:          http.StatusBadRequest,
+	RejectDuplicate:        http.StatusConflict,
+	RejectConflict:         http.StatusConflict,
+	RejectReplacementLimit: http.StatusConflict,
+	RejectTooManyAncestors: http.StatusUnprocessableEntity,
+	RejectFeeTooLow:        http.StatusPaymentRequired,
+	RejectMempoolMinFee:    http.StatusPaymentRequired,
+	RejectMempoolFull:      http.StatusServiceUnavailable,
+}
+
+// writeRejection reports a transaction the mempool refused as a
+// RejectResponse
+func writeRejection(w http.ResponseWriter, err error) {
+	resp := RejectResponse{Error: err.Error(), Reason: RejectInvalid}
+	var rejection *RejectError
+	if errors.As(err, &rejection) {
+		resp.Reason = rejection.Reason
+		resp.MinFee = rejection.MinFee
+	}
+	status, ok := rejectStatus[resp.Reason]
+	if !ok {
+		status = http.StatusBadRequest
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// GET /fees/estimate?target=N - Fee rate for confirmation within N blocks
+func (s *Server) estimateFee(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -74,26 +211,95 @@ func (s *Server) mineBlock(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
-	transactions := s.state.GetPendingTransactions()
-	if len(transactions) == 0 {
-		http.Error(w, "No transactions to mine", http.StatusBadRequest)
+	target := 0
+	if param := r.URL.Query().Get("target"); param != "" {
+		var err error
+		if target, err = strconv.Atoi(param); err != nil {
+			http.Error(w, "target must be a number of blocks", http.StatusBadRequest)
+			return
+		}
+	}
+	target, err := confirmTarget(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	if err := json.NewEncoder(w).Encode(s.state.EstimateFee(target)); err != nil {
+		http.Error(w, "Failed to encode fee estimate", http.StatusInternalServerError)
+		return
+	}
+}
+
+// confirmTarget checks a confirmation target, defaulting zero to
+// defaultConfirmTarget
+func confirmTarget(target int) (int, error) {
+	if target == 0 {
+		return defaultConfirmTarget, nil
+	}
+	if target < 1 || target > maxConfirmTarget {
+		return 0, fmt.Errorf("target must be between 1 and %d blocks", maxConfirmTarget)
+	}
+	return target, nil
+}
+
+// GET /mine - Mine a new block
+func (s *Server) mineBlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// The highest-paying pending transactions that fit. Blocks without
+	// pending transactions still pay the miner the subsidy.
+	template := s.state.GetBlockTemplate()
+
 	lastBlock := s.state.GetLastBlock()
-	newBlock := GenerateBlock(lastBlock, transactions)
+	newBlock := GenerateBlock(lastBlock, template.Transactions, s.state.GetMinerAddress(), s.state.GetNextBits())
 
 	if err := s.state.AddBlock(newBlock); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Broadcast new block to peers
-	BroadcastBlockchain(s.state.GetP2PHost(), s.state.GetChain())
+	// Announce the new block to peers
+	AnnounceBlock(s.state.GetP2PHost(), s.state, newBlock, "")
 
 	json.NewEncoder(w).Encode(newBlock)
 }
 
+// GET /balance - Get the balance of an address (defaults to the node wallet)
+func (s *Server) getBalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		address = s.state.GetWallet().GetAddress()
+	}
+	if err := ValidateAddress(address); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	utxos := s.state.GetUTXOSet().FindByAddress(address)
+	resp := BalanceResponse{Address: address, UTXOs: utxos}
+	for _, utxo := range utxos {
+		resp.Balance += utxo.Amount // Bounded by MaxMoney
+	}
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "Failed to encode balance", http.StatusInternalServerError)
+		return
+	}
+}
+
 // GET /peers - Get connected peers
 func (s *Server) getPeers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -115,16 +321,31 @@ func (s *Server) getPeers(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GET /sync - Get the progress of the initial block download
+func (s *Server) getSyncProgress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sm := s.state.GetSyncManager()
+	if sm == nil {
+		http.Error(w, "Sync is not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sm.Progress()); err != nil {
+		http.Error(w, "Failed to encode sync progress", http.StatusInternalServerError)
+		return
+	}
+}
+
 // Start starts the HTTP API server
 func (s *Server) Start(port string) error {
-	fmt.Println("🔍 DEBUG: Server.Start called")
-
 	// Setup routes with logging middleware
 	router := s.setupRoutesWithLogging()
-	fmt.Println("🔍 DEBUG: Routes setup complete")
-
 	addr := ":" + port
-	fmt.Printf("🔍 DEBUG: About to listen on %s\n", addr)
 
 	// Start server in a separate goroutine
 	errChan := make(chan error)
@@ -165,8 +386,12 @@ func (s *Server) setupRoutes() *http.ServeMux {
 	// Define routes
 	router.HandleFunc("/chain", s.getBlockchain)
 	router.HandleFunc("/transaction", s.createTransaction)
+	router.HandleFunc("/transaction/bumpfee", s.bumpFee)
 	router.HandleFunc("/mine", s.mineBlock)
 	router.HandleFunc("/peers", s.getPeers)
+	router.HandleFunc("/balance", s.getBalance)
+	router.HandleFunc("/sync", s.getSyncProgress)
+	router.HandleFunc("/fees/estimate", s.estimateFee)
 
 	return router
 }
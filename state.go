@@ -1,75 +1,218 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 // BlockchainState encapsulates all blockchain state
 type BlockchainState struct {
 	chain      []Block
 	pendingTxs []Transaction
+	utxos      *UTXOSet
 	mempool    *Mempool
+	fees       *FeeEstimator
 	wallet     *Wallet
 	p2pHost    host.Host
 	consensus  *Consensus
+	db         BlockchainDB
+	minerAddr  string
+
+	// Block tree: every known block, and undo records of connected blocks
+	index         *BlockIndex
+	orphans       *OrphanPool
+	undo          map[string]BlockUndo
+	reorgHandlers []func(ReorgEvent)
+	chainHandlers []func(ReorgEvent)
+
+	// Hashes of gossiped blocks and transactions already handled
+	seenBlocks *hashFilter
+	seenTxs    *hashFilter
+
+	// Handshakes of connected peers, and scores and bans of all peers
+	peers *PeerSet
+	bans  *BanManager
+	// Addresses of peers the node has handshaken with
+	addrBook *AddressBook
+	// Initial block download and catching up with better peers
+	syncManager *SyncManager
 
 	// Mutexes for thread safety
 	chainMutex sync.RWMutex
 	txMutex    sync.RWMutex
 }
 
-func (bs *BlockchainState) ReplaceChain(newChain []Block) {
-	bs.chainMutex.Lock()
-	defer bs.chainMutex.Unlock()
-	bs.chain = newChain
+// ReplaceChain adds the blocks of a chain received from a peer to the block
+// index. If the chain carries more work than ours the node reorganizes onto it.
+func (bs *BlockchainState) ReplaceChain(newChain []Block) error {
+	for _, block := range newChain {
+		if err := bs.AddBlock(block); err != nil && !errors.Is(err, ErrDuplicateBlock) {
+			return fmt.Errorf("invalid chain: %w", err)
+		}
+	}
+	return nil
 }
 
 // NewBlockchainState initializes a new blockchain state
 func NewBlockchainState() *BlockchainState {
 	fmt.Println("🔧 Creating new blockchain state...")
+	utxos := NewUTXOSet()
+	mempool := NewMempool(utxos)
 	state := &BlockchainState{
 		chain:      make([]Block, 0),
 		pendingTxs: make([]Transaction, 0),
-		mempool:    NewMempool(),
+		utxos:      utxos,
+		mempool:    mempool,
+		fees:       NewFeeEstimator(mempool),
 		consensus:  &Consensus{},
+		index:      NewBlockIndex(),
+		orphans:    NewOrphanPool(),
+		undo:       make(map[string]BlockUndo),
+		seenBlocks: newHashFilter(maxSeenItems),
+		seenTxs:    newHashFilter(maxSeenItems),
+		peers:      NewPeerSet(),
 	}
+	// The mempool drops what blocks confirm and takes back what reorgs undo
+	state.SubscribeChain(state.updateMempool)
+	state.SubscribeChain(func(event ReorgEvent) {
+		for _, block := range event.Added {
+			state.fees.BlockConnected(block)
+		}
+	})
 
 	fmt.Println("✨ Blockchain state created successfully")
 	return state
 }
 
 // Chain operations
-// Fix the AddBlock method to avoid deadlock
+
+// AddBlock adds a block to the block tree. A block extending the tip is
+// connected to the main chain; a block on a side branch is kept until its
+// branch carries more work, at which point the chain reorganizes onto it.
+// A block whose parent is unknown is kept as an orphan and ErrOrphanBlock is
+// returned.
 func (s *BlockchainState) AddBlock(block Block) error {
+	return s.AddBlockFromPeer(block, "")
+}
+
+// AddBlockFromPeer is AddBlock for a block received from a peer. If the
+// block is an orphan, the peer is asked for the missing ancestors.
+func (s *BlockchainState) AddBlockFromPeer(block Block, from peer.ID) error {
 	fmt.Printf("📦 Adding block %d to chain\n", block.Index)
 
+	s.chainMutex.Lock()
+	var events []ReorgEvent
+	event, err := s.addBlock(block)
+	if event != nil {
+		events = append(events, *event)
+	}
+	if err == nil {
+		events = append(events, s.connectOrphans(block.Hash)...)
+	}
+
+	// Stop walking back once the pool is full; chain sync covers deep gaps
+	missing := ""
+	if errors.Is(err, ErrOrphanBlock) && s.orphans.Len() < maxOrphanBlocks {
+		missing = s.orphans.Root(block.Hash)
+	}
+	reorgHandlers := s.reorgHandlers
+	chainHandlers := s.chainHandlers
+	s.chainMutex.Unlock()
+
+	if missing != "" && from != "" && s.p2pHost != nil {
+		go RequestMissingBlock(s.p2pHost, s, from, missing)
+	}
+
+	// An invalid block can still leave the chain changed, see reorganize
+	for _, event := range events {
+		for _, handler := range chainHandlers {
+			handler(event)
+		}
+		if len(event.Removed) == 0 {
+			continue
+		}
+		for _, handler := range reorgHandlers {
+			handler(event)
+		}
+	}
+	return err
+}
+
+// addBlock does the work of AddBlock and returns the change of the main
+// chain, or nil if there is none. Callers must hold chainMutex.
+func (s *BlockchainState) addBlock(block Block) (*ReorgEvent, error) {
+	if s.index.Lookup(block.Hash) != nil || s.orphans.Has(block.Hash) {
+		return nil, ErrDuplicateBlock
+	}
+
 	// Special case for genesis block
-	if len(s.chain) == 0 && block.Index == 0 {
-		s.chainMutex.Lock()
-		defer s.chainMutex.Unlock()
-		s.chain = append(s.chain, block)
+	if block.Index == 0 {
+		if len(s.chain) != 0 {
+			return nil, fmt.Errorf("invalid genesis block: chain already starts at %s", s.chain[0].Hash)
+		}
+		if err := ValidateBlock(block, nil); err != nil {
+			return nil, fmt.Errorf("invalid genesis block: %w", err)
+		}
+		if err := s.connectBlock(s.index.Add(block, nil)); err != nil {
+			s.index.Remove(block.Hash)
+			return nil, err
+		}
 		fmt.Println("🌟 Genesis block added successfully")
-		return nil
+		return &ReorgEvent{Added: []Block{block}}, nil
 	}
 
-	// Normal block addition logic
-	lastBlock := s.GetLastBlock()
-	if err := ValidateBlock(block, lastBlock); err != nil {
-		return fmt.Errorf("invalid block: %w", err)
+	parent := s.index.Lookup(block.PrevHash)
+	if parent == nil {
+		// Only the context-free checks can run without the parent
+		if err := CheckBlockSanity(block); err != nil {
+			return nil, fmt.Errorf("invalid block: %w", err)
+		}
+		s.orphans.Add(block)
+		fmt.Printf("👻 Block %d is an orphan, waiting for parent %s\n", block.Index, block.PrevHash)
+		return nil, ErrOrphanBlock
 	}
+	if err := ValidateBlock(block, s.ancestry(parent)); err != nil {
+		return nil, fmt.Errorf("invalid block: %w", err)
+	}
+	node := s.index.Add(block, parent)
 
-	s.chainMutex.Lock()
-	defer s.chainMutex.Unlock()
+	// Normal case: the block extends the main chain
+	tip := s.tipNode()
+	if parent == tip {
+		if err := s.connectBlock(node); err != nil {
+			s.index.Remove(block.Hash)
+			return nil, err
+		}
+		fmt.Printf("✅ Block %d added successfully\n", block.Index)
+		return &ReorgEvent{Added: []Block{block}}, nil
+	}
 
-	if len(s.chain) > 0 && s.chain[len(s.chain)-1].Hash != lastBlock.Hash {
-		return fmt.Errorf("chain changed during validation")
+	if s.db != nil {
+		if err := s.db.StoreBlock(block); err != nil {
+			s.index.Remove(block.Hash)
+			return nil, fmt.Errorf("failed to persist block %d: %w", block.Index, err)
+		}
+	}
+	if !node.isBetterThan(tip) {
+		fmt.Printf("🌿 Block %d stored on a side branch\n", block.Index)
+		return nil, nil
 	}
+	return s.reorganize(node)
+}
 
-	s.chain = append(s.chain, block)
-	fmt.Printf("✅ Block %d added successfully\n", block.Index)
+// persistBlock writes the block through to the store, if one is configured.
+// Callers must hold chainMutex.
+func (s *BlockchainState) persistBlock(block Block) error {
+	if s.db == nil {
+		return nil
+	}
+	if err := s.db.SaveBlock(block); err != nil {
+		return fmt.Errorf("failed to persist block %d: %w", block.Index, err)
+	}
 	return nil
 }
 
@@ -79,6 +222,39 @@ func (s *BlockchainState) GetChain() []Block {
 	return s.chain
 }
 
+// GetChainRange returns the main-chain blocks from height start to end,
+// inclusive, at most max of them
+func (s *BlockchainState) GetChainRange(start, end, max int) []Block {
+	s.chainMutex.RLock()
+	defer s.chainMutex.RUnlock()
+
+	if start < 0 {
+		start = 0
+	}
+	if end >= len(s.chain) {
+		end = len(s.chain) - 1
+	}
+	if end-start+1 > max {
+		end = start + max - 1
+	}
+	if start > end {
+		return nil
+	}
+	return s.chain[start : end+1 : end+1]
+}
+
+// GetBlockByHash returns a block of the block tree, on the main chain or a
+// side branch
+func (s *BlockchainState) GetBlockByHash(hash string) (Block, bool) {
+	s.chainMutex.RLock()
+	defer s.chainMutex.RUnlock()
+	node := s.index.Lookup(hash)
+	if node == nil {
+		return Block{}, false
+	}
+	return node.block, true
+}
+
 func (s *BlockchainState) GetLastBlock() Block {
 	s.chainMutex.RLock()
 	defer s.chainMutex.RUnlock()
@@ -96,6 +272,7 @@ func (s *BlockchainState) AddTransaction(tx Transaction) error {
 	if err := s.mempool.AddTransaction(tx); err != nil {
 		return fmt.Errorf("failed to add transaction: %w", err)
 	}
+	s.fees.TxAdded(tx, s.utxos.Height())
 	return nil
 }
 
@@ -103,6 +280,106 @@ func (s *BlockchainState) GetPendingTransactions() []Transaction {
 	return s.mempool.GetTransactions()
 }
 
+// GetPendingTransaction returns a transaction of the mempool by TxID
+func (s *BlockchainState) GetPendingTransaction(txID string) (Transaction, bool) {
+	return s.mempool.GetTransaction(txID)
+}
+
+// SetMempoolPolicy changes the mempool limits and minimum relay fee
+func (s *BlockchainState) SetMempoolPolicy(policy MempoolPolicy) {
+	s.mempool.SetPolicy(policy)
+}
+
+// GetMempoolMinFee returns the lowest fee rate the mempool accepts
+func (s *BlockchainState) GetMempoolMinFee() FeeRate {
+	return s.mempool.MinFee()
+}
+
+// EstimateFee returns the fee rate for confirmation within target blocks
+func (s *BlockchainState) EstimateFee(target int) FeeEstimate {
+	return s.fees.Estimate(target, s.utxos.Height())
+}
+
+// GetBlockTemplate selects the pending transactions for the next block
+func (s *BlockchainState) GetBlockTemplate() BlockTemplate {
+	return s.mempool.BlockTemplate(MaxBlockSize - blockTemplateReserve)
+}
+
+// UTXO operations
+func (s *BlockchainState) GetUTXOSet() *UTXOSet {
+	return s.utxos
+}
+
+// GetSpendableUTXOs returns the confirmed, mature outputs of an address that
+// no pending transaction spends yet
+func (s *BlockchainState) GetSpendableUTXOs(address string) []UTXO {
+	spendHeight := s.utxos.Height() + 1
+	spendable := make([]UTXO, 0)
+	for _, utxo := range s.utxos.FindByAddress(address) {
+		if utxo.IsMatureAt(spendHeight) && !s.mempool.IsSpent(utxo.Outpoint()) {
+			spendable = append(spendable, utxo)
+		}
+	}
+	return spendable
+}
+
+// Storage operations
+func (s *BlockchainState) SetDB(db BlockchainDB) {
+	s.db = db
+}
+
+// LoadChain restores the chain from the store and returns its length
+func (s *BlockchainState) LoadChain() (int, error) {
+	if s.db == nil {
+		return 0, fmt.Errorf("no database configured")
+	}
+
+	chain, err := s.db.LoadChain()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load chain: %w", err)
+	}
+	if len(chain) > 0 && !ValidateBlockchain(chain) {
+		return 0, fmt.Errorf("stored chain failed validation")
+	}
+
+	// Replay the chain to rebuild the UTXO set, undo records and block index
+	utxos := NewUTXOSet()
+	index := NewBlockIndex()
+	undo := make(map[string]BlockUndo)
+	var tip *blockNode
+	for _, block := range chain {
+		blockUndo, err := utxos.ConnectBlock(block)
+		if err != nil {
+			return 0, fmt.Errorf("failed to rebuild UTXO set: block %d: %w", block.Index, err)
+		}
+		undo[block.Hash] = blockUndo
+		tip = index.Add(block, tip)
+	}
+
+	// Side branches were validated before they were stored, and branch
+	// blocks that failed to connect during a reorg were deleted again
+	blocks, err := s.db.LoadBlocks()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load blocks: %w", err)
+	}
+	for _, block := range blocks {
+		if index.Lookup(block.Hash) != nil {
+			continue
+		}
+		if parent := index.Lookup(block.PrevHash); parent != nil {
+			index.Add(block, parent)
+		}
+	}
+
+	s.chainMutex.Lock()
+	defer s.chainMutex.Unlock()
+	s.chain = chain
+	s.index = index
+	s.undo = undo
+	s.utxos.Replace(utxos)
+	return len(chain), nil
+}
+
 // P2P operations
 func (s *BlockchainState) SetP2PHost(h host.Host) {
 	s.p2pHost = h
@@ -112,6 +389,58 @@ func (s *BlockchainState) GetP2PHost() host.Host {
 	return s.p2pHost
 }
 
+// GetPeers returns the handshakes of connected peers
+func (s *BlockchainState) GetPeers() *PeerSet {
+	return s.peers
+}
+
+func (s *BlockchainState) SetBanManager(bm *BanManager) {
+	s.bans = bm
+}
+
+// GetBanManager returns the peer scores and bans, or nil if none are kept
+func (s *BlockchainState) GetBanManager() *BanManager {
+	return s.bans
+}
+
+func (s *BlockchainState) SetAddressBook(ab *AddressBook) {
+	s.addrBook = ab
+}
+
+// GetAddressBook returns the known peer addresses, or nil if none are kept
+func (s *BlockchainState) GetAddressBook() *AddressBook {
+	return s.addrBook
+}
+
+func (s *BlockchainState) SetSyncManager(sm *SyncManager) {
+	s.syncManager = sm
+}
+
+// GetSyncManager returns the sync manager, or nil if the node does not sync
+func (s *BlockchainState) GetSyncManager() *SyncManager {
+	return s.syncManager
+}
+
+// Mining operations
+
+// GetNextBits returns the difficulty the next block on the tip must carry
+func (s *BlockchainState) GetNextBits() uint32 {
+	return CalcNextBits(s.GetChain())
+}
+
+func (s *BlockchainState) SetMinerAddress(address string) {
+	s.minerAddr = address
+}
+
+// GetMinerAddress returns the address that receives block rewards, falling
+// back to the node wallet
+func (s *BlockchainState) GetMinerAddress() string {
+	if s.minerAddr == "" && s.wallet != nil {
+		return s.wallet.GetAddress()
+	}
+	return s.minerAddr
+}
+
 // Wallet operations
 func (s *BlockchainState) SetWallet(w *Wallet) {
 	s.wallet = w
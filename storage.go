@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const chainDBFile = "chain.db"
+
+var (
+	// blocksBucket maps block hash -> encoded block, see EncodeBlock
+	blocksBucket = []byte("blocks")
+	// chainBucket maps big-endian block height -> block hash of the main chain
+	chainBucket = []byte("chain")
+	// bansBucket maps raw peer ID -> big-endian Unix time the ban ends
+	bansBucket = []byte("bans")
+	// peersBucket maps raw peer ID -> address book entry, see encodeAddrEntry
+	peersBucket = []byte("peers")
+)
+
+// ErrBlockNotFound is returned when a block hash is not in the store
+var ErrBlockNotFound = errors.New("block not found")
+
+// BoltDB implements BlockchainDB on top of an embedded bbolt key-value store
+type BoltDB struct {
+	db *bolt.DB
+}
+
+// OpenBoltDB opens (or creates) the chain database inside dataDir
+func OpenBoltDB(dataDir string) (*BoltDB, error) {
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	path := filepath.Join(dataDir, chainDBFile)
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{blocksBucket, chainBucket, bansBucket, peersBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	return &BoltDB{db: db}, nil
+}
+
+// Close releases the database file lock
+func (b *BoltDB) Close() error {
+	return b.db.Close()
+}
+
+// SaveBlock stores the block and makes it the main-chain tip at its height
+func (b *BoltDB) SaveBlock(block Block) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := putBlock(tx, block); err != nil {
+			return err
+		}
+
+		// Drop any main-chain entries above the new tip
+		chain := tx.Bucket(chainBucket)
+		c := chain.Cursor()
+		for k, _ := c.Seek(heightKey(block.Index + 1)); k != nil; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return chain.Put(heightKey(block.Index), []byte(block.Hash))
+	})
+}
+
+// StoreBlock stores a block without changing the main chain, e.g. a block
+// of a side branch
+func (b *BoltDB) StoreBlock(block Block) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putBlock(tx, block)
+	})
+}
+
+// DeleteBlocks removes blocks that are not on the main chain, e.g. a side
+// branch that turned out to be invalid
+func (b *BoltDB) DeleteBlocks(hashes []string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket(blocksBucket)
+		for _, hash := range hashes {
+			if err := blocks.Delete([]byte(hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetBlock loads a block by its hash
+func (b *BoltDB) GetBlock(hash string) (Block, error) {
+	var block Block
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(blocksBucket).Get([]byte(hash))
+		if data == nil {
+			return ErrBlockNotFound
+		}
+		var err error
+		block, err = DecodeBlock(data)
+		return err
+	})
+	return block, err
+}
+
+// SaveChain replaces the stored main chain with the given blocks
+func (b *BoltDB) SaveChain(chain []Block) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(chainBucket); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket(chainBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, block := range chain {
+			if err := putBlock(tx, block); err != nil {
+				return err
+			}
+			if err := bucket.Put(heightKey(block.Index), []byte(block.Hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadChain returns the stored main chain ordered by height
+func (b *BoltDB) LoadChain() ([]Block, error) {
+	chain := make([]Block, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket(blocksBucket)
+		return tx.Bucket(chainBucket).ForEach(func(k, hash []byte) error {
+			data := blocks.Get(hash)
+			if data == nil {
+				return fmt.Errorf("%w: %s at height %d", ErrBlockNotFound, hash, binary.BigEndian.Uint64(k))
+			}
+
+			block, err := DecodeBlock(data)
+			if err != nil {
+				return fmt.Errorf("failed to decode block %s: %w", hash, err)
+			}
+			chain = append(chain, block)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// LoadBlocks returns every stored block, main chain and side branches,
+// ordered by height
+func (b *BoltDB) LoadBlocks() ([]Block, error) {
+	blocks := make([]Block, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(blocksBucket).ForEach(func(hash, data []byte) error {
+			block, err := DecodeBlock(data)
+			if err != nil {
+				return fmt.Errorf("failed to decode block %s: %w", hash, err)
+			}
+			blocks = append(blocks, block)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].Index < blocks[j].Index
+	})
+	return blocks, nil
+}
+
+// SaveBan records that a peer is banned until the given time
+func (b *BoltDB) SaveBan(id string, until time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(until.Unix()))
+		return tx.Bucket(bansBucket).Put([]byte(id), value)
+	})
+}
+
+// DeleteBan lifts the ban of a peer
+func (b *BoltDB) DeleteBan(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bansBucket).Delete([]byte(id))
+	})
+}
+
+// LoadBans returns every recorded ban, expired or not
+func (b *BoltDB) LoadBans() (map[string]time.Time, error) {
+	bans := make(map[string]time.Time)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bansBucket).ForEach(func(id, value []byte) error {
+			if len(value) != 8 {
+				return fmt.Errorf("corrupt ban record for %s", id)
+			}
+			bans[string(id)] = time.Unix(int64(binary.BigEndian.Uint64(value)), 0)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+// SavePeerAddrs records the address book entry of a peer
+func (b *BoltDB) SavePeerAddrs(id string, entry AddrEntry) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(peersBucket).Put([]byte(id), encodeAddrEntry(entry))
+	})
+}
+
+// DeletePeerAddrs removes a peer from the address book
+func (b *BoltDB) DeletePeerAddrs(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(peersBucket).Delete([]byte(id))
+	})
+}
+
+// LoadPeerAddrs returns the whole address book
+func (b *BoltDB) LoadPeerAddrs() (map[string]AddrEntry, error) {
+	entries := make(map[string]AddrEntry)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(peersBucket).ForEach(func(id, value []byte) error {
+			entry, err := decodeAddrEntry(value)
+			if err != nil {
+				return fmt.Errorf("corrupt address book entry for %s: %w", id, err)
+			}
+			entries[string(id)] = entry
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func putBlock(tx *bolt.Tx, block Block) error {
+	return tx.Bucket(blocksBucket).Put([]byte(block.Hash), EncodeBlock(block))
+}
+
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+	return key
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestBoltDBPersistsChain(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := OpenBoltDB(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	state := NewBlockchainState()
+	state.SetDB(db)
+
+	genesis := CreateGenesisBlock()
+	if err := state.AddBlock(genesis); err != nil {
+		t.Fatalf("Failed to add genesis block: %v", err)
+	}
+
+	block := GenerateBlock(genesis, []Transaction{}, newTestAddress(t), CalcNextBits([]Block{genesis}))
+	if err := state.AddBlock(block); err != nil {
+		t.Fatalf("Failed to add block: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	// Reopen as a restarted node would
+	db, err = OpenBoltDB(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	restored := NewBlockchainState()
+	restored.SetDB(db)
+	height, err := restored.LoadChain()
+	if err != nil {
+		t.Fatalf("LoadChain() error = %v", err)
+	}
+	if height != 2 {
+		t.Fatalf("LoadChain() height = %d, want 2", height)
+	}
+	if restored.GetLastBlock().Hash != block.Hash {
+		t.Errorf("Restored tip = %s, want %s", restored.GetLastBlock().Hash, block.Hash)
+	}
+
+	stored, err := db.GetBlock(genesis.Hash)
+	if err != nil {
+		t.Fatalf("GetBlock() error = %v", err)
+	}
+	if stored.Hash != genesis.Hash {
+		t.Errorf("GetBlock() hash = %s, want %s", stored.Hash, genesis.Hash)
+	}
+}
+
+func TestBoltDBSaveChainTruncates(t *testing.T) {
+	db, err := OpenBoltDB(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	genesis := CreateGenesisBlock()
+	block := GenerateBlock(genesis, []Transaction{}, newTestAddress(t), CalcNextBits([]Block{genesis}))
+
+	if err := db.SaveChain([]Block{genesis, block}); err != nil {
+		t.Fatalf("SaveChain() error = %v", err)
+	}
+	if err := db.SaveChain([]Block{genesis}); err != nil {
+		t.Fatalf("SaveChain() error = %v", err)
+	}
+
+	chain, err := db.LoadChain()
+	if err != nil {
+		t.Fatalf("LoadChain() error = %v", err)
+	}
+	if len(chain) != 1 {
+		t.Errorf("LoadChain() length = %d, want 1", len(chain))
+	}
+}
+
+func TestBoltDBDropsInvalidBranch(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	dir := t.TempDir()
+	db, err := OpenBoltDB(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	state := NewBlockchainState()
+	state.SetDB(db)
+	genesis := CreateGenesisBlock()
+	if err := state.AddBlock(genesis); err != nil {
+		t.Fatalf("Failed to add genesis block: %v", err)
+	}
+	chain := []Block{genesis}
+	for i := 0; i < 2; i++ {
+		chain = append(chain, GenerateBlock(chain[len(chain)-1], nil, newTestAddress(t), state.GetNextBits()))
+		if err := state.AddBlock(chain[len(chain)-1]); err != nil {
+			t.Fatalf("AddBlock() error = %v", err)
+		}
+	}
+
+	// The branch passes block validation but spends an output that does not
+	// exist, which only shows when it is connected
+	missing := UTXO{TxID: strings.Repeat("ab", 32), Amount: Coins(1), Address: wallet.GetAddress()}
+	tx, err := wallet.CreateTransaction([]UTXO{missing}, newTestAddress(t), Coins(1)/2, BaseUnitsPerCoin/1000)
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	if err := wallet.SignTransaction(&tx); err != nil {
+		t.Fatalf("Failed to sign transaction: %v", err)
+	}
+	branch := []Block{genesis}
+	branch = append(branch, GenerateBlock(genesis, []Transaction{tx}, newTestAddress(t), CalcNextBits(branch)))
+	for i := 0; i < 2; i++ {
+		branch = append(branch, GenerateBlock(branch[len(branch)-1], nil, newTestAddress(t), CalcNextBits(branch)))
+	}
+	for _, block := range branch[1:] {
+		state.AddBlock(block)
+	}
+	if tip := state.GetLastBlock(); tip.Hash != chain[2].Hash {
+		t.Fatalf("Tip = %s, want the valid chain", tip.Hash)
+	}
+	for _, block := range branch[1:] {
+		if _, err := db.GetBlock(block.Hash); !errors.Is(err, ErrBlockNotFound) {
+			t.Errorf("GetBlock() of invalid branch block %d error = %v, want %v", block.Index, err, ErrBlockNotFound)
+		}
+	}
+
+	// A restarted node does not index the branch again
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db, err = OpenBoltDB(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	restored := NewBlockchainState()
+	restored.SetDB(db)
+	if _, err := restored.LoadChain(); err != nil {
+		t.Fatalf("LoadChain() error = %v", err)
+	}
+	if restored.index.Lookup(branch[1].Hash) != nil {
+		t.Error("LoadChain() indexed a block that failed to connect")
+	}
+}
+
+func TestBoltDBPersistsBans(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenBoltDB(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	bans, err := NewBanManager(db, time.Hour)
+	if err != nil {
+		t.Fatalf("NewBanManager() error = %v", err)
+	}
+	bad, good := peer.ID("bad"), peer.ID("good")
+
+	// Penalties add up until the score reaches zero
+	if bans.Penalize(bad, PenaltyMalformedMessage, "test") || bans.Score(bad) != initialPeerScore-PenaltyMalformedMessage {
+		t.Errorf("Score() = %d after one penalty", bans.Score(bad))
+	}
+	if !bans.Penalize(bad, PenaltyInvalidBlock, "test") || !bans.IsBanned(bad) {
+		t.Fatal("Peer below the threshold was not banned")
+	}
+	if bans.InterceptPeerDial(bad) || bans.InterceptSecured(0, bad, nil) {
+		t.Error("ConnectionGater let a banned peer through")
+	}
+	if bans.IsBanned(good) || !bans.InterceptSecured(0, good, nil) {
+		t.Error("ConnectionGater refused a peer in good standing")
+	}
+
+	// Penalties wear off over time
+	now := time.Now()
+	bans.now = func() time.Time { return now }
+	bans.Penalize(good, 2*PenaltyMalformedMessage, "test")
+	now = now.Add(peerScoreHalfLife)
+	if got, want := bans.Score(good), initialPeerScore-PenaltyMalformedMessage; got != want {
+		t.Errorf("Score() after a half-life = %d, want %d", got, want)
+	}
+	now = now.Add(12 * peerScoreHalfLife)
+	if got := bans.Score(good); got != initialPeerScore {
+		t.Errorf("Score() long after a penalty = %d, want %d", got, initialPeerScore)
+	}
+	bans.Penalize(good, PenaltyUnsolicited, "test")
+	now = now.Add(12 * peerScoreHalfLife)
+	bans.Penalize(bad, PenaltyUnsolicited, "test")
+	if _, ok := bans.scores[good]; ok || len(bans.scores) != 1 {
+		t.Errorf("Decayed penalties were kept: %v", bans.scores)
+	}
+	bans.now = time.Now
+
+	// Bans survive a restart and expire after the ban duration
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db, err = OpenBoltDB(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	restored, err := NewBanManager(db, time.Hour)
+	if err != nil {
+		t.Fatalf("NewBanManager() error = %v", err)
+	}
+	if !restored.IsBanned(bad) {
+		t.Fatal("Ban was not restored after a restart")
+	}
+	restored.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if restored.IsBanned(bad) {
+		t.Error("Ban did not expire")
+	}
+	if stored, err := db.LoadBans(); err != nil || len(stored) != 0 {
+		t.Errorf("LoadBans() = %v, %v, want the expired ban lifted", stored, err)
+	}
+}
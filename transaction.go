@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"time"
 
@@ -10,40 +11,123 @@ import (
 	"crypto/elliptic"
 )
 
-// Transaction represents a simple transaction
+// ErrInvalidSignature is returned for a transaction whose signature does not
+// verify against its sender's public key
+var ErrInvalidSignature = errors.New("invalid transaction signature")
+
+// Transaction spends outputs of previous transactions (Inputs) and creates
+// new ones (Outputs). All inputs must belong to SenderAddress; whatever the
+// inputs hold beyond the outputs is paid to the miner as Fee.
 type Transaction struct {
 	TxID            string
 	SenderPublicKey []byte // Added field
 	SenderAddress   string // Added field
-	Receiver        string
-	Amount          float64
+	Inputs          []TxInput
+	Outputs         []TxOutput
 	Timestamp       time.Time
 	Signature       []byte
-	Fee             float64
+	Fee             Amount
+}
+
+// TxInput references an output of a previous transaction
+type TxInput struct {
+	TxID  string
+	Index int
+}
+
+// TxOutput pays an amount to an address
+type TxOutput struct {
+	Address string
+	Amount  Amount
 }
 
 // UTXO represents an unspent transaction output
 type UTXO struct {
-	TxID   string
-	Index  int
-	Amount float64
+	TxID     string
+	Index    int
+	Amount   Amount
+	Address  string
+	Height   int  // Height of the block that created the output
+	Coinbase bool // Created by a coinbase, so subject to maturity
+}
+
+// Outpoint identifies a transaction output
+type Outpoint struct {
+	TxID  string
+	Index int
+}
+
+func (in TxInput) Outpoint() Outpoint {
+	return Outpoint{TxID: in.TxID, Index: in.Index}
+}
+
+func (u UTXO) Outpoint() Outpoint {
+	return Outpoint{TxID: u.TxID, Index: u.Index}
+}
+
+// IsMatureAt reports whether the output may be spent in a block at height
+func (u UTXO) IsMatureAt(height int) bool {
+	return !u.Coinbase || height-u.Height >= activeParams.CoinbaseMaturity
+}
+
+// IsCoinbase reports whether the transaction mints the block reward. A
+// coinbase has a single input with an empty TxID whose Index is the height
+// of its block, which keeps coinbase TxIDs unique.
+func (tx Transaction) IsCoinbase() bool {
+	return len(tx.Inputs) == 1 && tx.Inputs[0].TxID == ""
+}
+
+// NewCoinbaseTransaction pays reward to the miner of the block at height
+func NewCoinbaseTransaction(minerAddress string, height int, reward Amount) Transaction {
+	tx := Transaction{
+		Inputs:    []TxInput{{TxID: "", Index: height}},
+		Outputs:   []TxOutput{{Address: minerAddress, Amount: reward}},
+		Timestamp: time.Now(),
+	}
+	tx.TxID = CalculateTxID(tx)
+	return tx
+}
+
+// TotalOutput returns the sum of all outputs
+func (tx Transaction) TotalOutput() (Amount, error) {
+	var total Amount
+	for _, out := range tx.Outputs {
+		var err error
+		if total, err = total.Add(out.Amount); err != nil {
+			return 0, fmt.Errorf("transaction %s outputs: %w", tx.TxID, err)
+		}
+	}
+	return total, nil
+}
+
+// txSigningData builds the preimage that is signed and hashed into the TxID:
+// the canonical encoding without the TxID and the signature
+func txSigningData(tx Transaction) []byte {
+	var e encoder
+	encodeTransaction(&e, tx, true)
+	return e.buf.Bytes()
 }
 
 // Calculate transaction hash (TxID)
 func CalculateTxID(tx Transaction) string {
-	record := tx.SenderAddress + tx.Receiver + fmt.Sprintf("%f", tx.Amount)
-	hash := sha256.Sum256([]byte(record))
+	hash := sha256.Sum256(txSigningData(tx))
 	return hex.EncodeToString(hash[:])
 }
 
-func CalculateBlockReward(block Block) float64 {
-	baseReward := 50.0 // Base mining reward
-	totalFees := 0.0
+// CalculateBlockReward returns the subsidy at the block's height plus the
+// fees of every non-coinbase transaction in the block
+func CalculateBlockReward(block Block) (Amount, error) {
+	reward := activeParams.BlockSubsidyAt(block.Index)
 
 	for _, tx := range block.Transactions {
-		totalFees += tx.Fee
+		if !tx.IsCoinbase() {
+			var err error
+			if reward, err = reward.Add(tx.Fee); err != nil {
+				return 0, fmt.Errorf("block reward: %w", err)
+			}
+		}
 	}
-	return baseReward + totalFees
+	return reward, nil
 }
 
 func ValidateTransaction(tx Transaction, pubKeyBytes []byte) bool {
@@ -66,18 +150,123 @@ func ValidateTransaction(tx Transaction, pubKeyBytes []byte) bool {
 	}
 
 	// Calculate transaction hash (same as signing)
-	txData := fmt.Sprintf("%s%s%f%v",
-		tx.SenderAddress,
-		tx.Receiver,
-		tx.Amount,
-		tx.Timestamp.Unix())
-
-	txHash := sha256.Sum256([]byte(txData))
+	txHash := sha256.Sum256(txSigningData(tx))
 
 	// Verify signature
 	return ecdsa.VerifyASN1(pubKey, txHash[:], tx.Signature)
 }
 
+// CheckTransaction performs the checks that need no chain state: structure,
+// amounts, addresses, TxID and signature.
+func CheckTransaction(tx Transaction) error {
+	if tx.IsCoinbase() {
+		return checkCoinbase(tx)
+	}
+
+	if len(tx.Inputs) == 0 {
+		return fmt.Errorf("transaction %s has no inputs", tx.TxID)
+	}
+	if len(tx.Outputs) == 0 {
+		return fmt.Errorf("transaction %s has no outputs", tx.TxID)
+	}
+	if !tx.Fee.IsValid() {
+		return fmt.Errorf("transaction %s fee: %w", tx.TxID, ErrAmountOutOfRange)
+	}
+
+	seen := make(map[Outpoint]bool, len(tx.Inputs))
+	for _, in := range tx.Inputs {
+		if in.TxID == "" {
+			return fmt.Errorf("transaction %s mixes a coinbase input with regular inputs", tx.TxID)
+		}
+		if seen[in.Outpoint()] {
+			return fmt.Errorf("transaction %s spends %s:%d twice", tx.TxID, in.TxID, in.Index)
+		}
+		seen[in.Outpoint()] = true
+	}
+
+	for i, out := range tx.Outputs {
+		if out.Amount <= 0 || !out.Amount.IsValid() {
+			return fmt.Errorf("transaction %s output %d: %w", tx.TxID, i, ErrAmountOutOfRange)
+		}
+		if err := ValidateAddress(out.Address); err != nil {
+			return fmt.Errorf("transaction %s output %d: %w", tx.TxID, i, err)
+		}
+	}
+
+	if tx.TxID != CalculateTxID(tx) {
+		return fmt.Errorf("transaction %s has an invalid TxID", tx.TxID)
+	}
+	if !ValidateTransaction(tx, tx.SenderPublicKey) {
+		return fmt.Errorf("transaction %s: %w", tx.TxID, ErrInvalidSignature)
+	}
+	return nil
+}
+
+// checkCoinbase validates the structure of a coinbase; its amount is
+// checked against the block reward when the block is connected
+func checkCoinbase(tx Transaction) error {
+	if tx.Inputs[0].Index < 0 {
+		return fmt.Errorf("coinbase %s has a negative height", tx.TxID)
+	}
+	if tx.Fee != 0 {
+		return fmt.Errorf("coinbase %s must not pay a fee", tx.TxID)
+	}
+	if len(tx.Outputs) == 0 {
+		return fmt.Errorf("coinbase %s has no outputs", tx.TxID)
+	}
+	for i, out := range tx.Outputs {
+		if !out.Amount.IsValid() {
+			return fmt.Errorf("coinbase %s output %d: %w", tx.TxID, i, ErrAmountOutOfRange)
+		}
+		if err := ValidateAddress(out.Address); err != nil {
+			return fmt.Errorf("coinbase %s output %d: %w", tx.TxID, i, err)
+		}
+	}
+	if tx.TxID != CalculateTxID(tx) {
+		return fmt.Errorf("coinbase %s has an invalid TxID", tx.TxID)
+	}
+	return nil
+}
+
+// CheckTransactionInputs verifies every input refers to an unspent output
+// owned by the sender and spendable at spendHeight, and that inputs cover
+// the outputs plus the fee.
+func CheckTransactionInputs(tx Transaction, view UTXOView, spendHeight int) error {
+	var totalIn Amount
+	for _, in := range tx.Inputs {
+		utxo, ok := view.GetUTXO(in.Outpoint())
+		if !ok {
+			return fmt.Errorf("%w: %s:%d", ErrMissingOrSpentOutput, in.TxID, in.Index)
+		}
+		if !utxo.IsMatureAt(spendHeight) {
+			return fmt.Errorf("%w: %s:%d created at height %d", ErrImmatureCoinbase, in.TxID, in.Index, utxo.Height)
+		}
+		if utxo.Address != tx.SenderAddress {
+			return fmt.Errorf("output %s:%d is not owned by %s", in.TxID, in.Index, tx.SenderAddress)
+		}
+		var err error
+		if totalIn, err = totalIn.Add(utxo.Amount); err != nil {
+			return fmt.Errorf("transaction %s inputs: %w", tx.TxID, err)
+		}
+	}
+
+	totalOut, err := tx.TotalOutput()
+	if err != nil {
+		return err
+	}
+	needed, err := totalOut.Add(tx.Fee)
+	if err != nil {
+		return fmt.Errorf("transaction %s outputs plus fee: %w", tx.TxID, err)
+	}
+	if totalIn < needed {
+		return fmt.Errorf("insufficient funds: inputs %s < outputs %s + fee %s", totalIn, totalOut, tx.Fee)
+	}
+	if totalIn > needed {
+		return fmt.Errorf("inputs %s exceed outputs %s + fee %s", totalIn, totalOut, tx.Fee)
+	}
+	return nil
+}
+
 // func ValidateTransaction(tx Transaction, signature []byte) bool {
 // 	// Verify amount
 // 	if tx.Amount <= 0 {
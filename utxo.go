@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrMissingOrSpentOutput is returned when an input references an output
+// that never existed or has already been spent
+var ErrMissingOrSpentOutput = errors.New("referenced output is missing or already spent")
+
+// Coinbase errors
+var (
+	ErrMissingCoinbase   = errors.New("block must start with a coinbase transaction")
+	ErrBadCoinbaseReward = errors.New("coinbase does not pay the exact block reward")
+	ErrImmatureCoinbase  = errors.New("coinbase output spent before maturity")
+)
+
+// UTXOView gives read access to unspent outputs
+type UTXOView interface {
+	GetUTXO(op Outpoint) (UTXO, bool)
+}
+
+// UTXOSet tracks every unspent output of the main chain
+type UTXOSet struct {
+	utxos  map[Outpoint]UTXO
+	height int // Height of the last applied block, -1 when empty
+	mutex  sync.RWMutex
+}
+
+func NewUTXOSet() *UTXOSet {
+	return &UTXOSet{
+		utxos:  make(map[Outpoint]UTXO),
+		height: -1,
+	}
+}
+
+// Height returns the height of the last block applied to the set
+func (u *UTXOSet) Height() int {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.height
+}
+
+// GetUTXO implements UTXOView
+func (u *UTXOSet) GetUTXO(op Outpoint) (UTXO, bool) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	utxo, ok := u.utxos[op]
+	return utxo, ok
+}
+
+// FindByAddress returns the unspent outputs owned by an address, sorted by outpoint
+func (u *UTXOSet) FindByAddress(address string) []UTXO {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	result := make([]UTXO, 0)
+	for _, utxo := range u.utxos {
+		if utxo.Address == address {
+			result = append(result, utxo)
+		}
+	}
+	sortUTXOs(result)
+	return result
+}
+
+// Balance returns the total unspent amount owned by an address
+func (u *UTXOSet) Balance(address string) Amount {
+	var total Amount
+	for _, utxo := range u.FindByAddress(address) {
+		total += utxo.Amount
+	}
+	return total
+}
+
+// BlockUndo records the outputs a connected block spent, so that
+// disconnecting the block can restore them
+type BlockUndo struct {
+	Spent []UTXO
+}
+
+// ApplyBlock validates every transaction of the block against the set and,
+// only if all of them are valid, spends their inputs and adds their outputs.
+func (u *UTXOSet) ApplyBlock(block Block) error {
+	_, err := u.ConnectBlock(block)
+	return err
+}
+
+// ConnectBlock applies the block like ApplyBlock and returns its undo record
+func (u *UTXOSet) ConnectBlock(block Block) (BlockUndo, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	diff, err := u.blockDiff(block)
+	if err != nil {
+		return BlockUndo{}, err
+	}
+
+	for _, utxo := range diff.spent {
+		delete(u.utxos, utxo.Outpoint())
+	}
+	for _, utxo := range diff.created {
+		u.utxos[utxo.Outpoint()] = utxo
+	}
+	u.height = block.Index
+	return BlockUndo{Spent: diff.spent}, nil
+}
+
+// DisconnectBlock reverts the last connected block: its outputs are removed
+// and the outputs it spent are restored from the undo record
+func (u *UTXOSet) DisconnectBlock(block Block, undo BlockUndo) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if block.Index != u.height {
+		return fmt.Errorf("cannot disconnect block %d, tip is at height %d", block.Index, u.height)
+	}
+
+	for _, tx := range block.Transactions {
+		for i := range tx.Outputs {
+			delete(u.utxos, Outpoint{TxID: tx.TxID, Index: i})
+		}
+	}
+	for _, utxo := range undo.Spent {
+		u.utxos[utxo.Outpoint()] = utxo
+	}
+	u.height = block.Index - 1
+	return nil
+}
+
+// CheckBlock reports whether ApplyBlock would succeed, without changing the set
+func (u *UTXOSet) CheckBlock(block Block) error {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	_, err := u.blockDiff(block)
+	return err
+}
+
+// Replace swaps in the contents of another set
+func (u *UTXOSet) Replace(other *UTXOSet) {
+	other.mutex.RLock()
+	utxos, height := other.utxos, other.height
+	other.mutex.RUnlock()
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.utxos = utxos
+	u.height = height
+}
+
+// utxoDiff lists the outputs a block spends and creates
+type utxoDiff struct {
+	spent   []UTXO
+	created []UTXO
+}
+
+// blockView overlays the outputs created and spent earlier in the same block
+type blockView struct {
+	base    map[Outpoint]UTXO
+	created map[Outpoint]UTXO
+	spent   map[Outpoint]bool
+}
+
+func (v *blockView) GetUTXO(op Outpoint) (UTXO, bool) {
+	if v.spent[op] {
+		return UTXO{}, false
+	}
+	if utxo, ok := v.created[op]; ok {
+		return utxo, true
+	}
+	utxo, ok := v.base[op]
+	return utxo, ok
+}
+
+// blockDiff computes the changes of a block. Callers must hold the mutex.
+func (u *UTXOSet) blockDiff(block Block) (utxoDiff, error) {
+	var diff utxoDiff
+	view := &blockView{
+		base:    u.utxos,
+		created: make(map[Outpoint]UTXO),
+		spent:   make(map[Outpoint]bool),
+	}
+
+	for _, tx := range block.Transactions {
+		switch {
+		case tx.IsCoinbase():
+			// The coinbase is checked by CheckBlockSanity
+		case len(tx.Inputs) == 0:
+			// Only the genesis allocations create coins out of nothing
+			if block.Index != 0 {
+				return diff, fmt.Errorf("transaction %s has no inputs", tx.TxID)
+			}
+		default:
+			if err := CheckTransactionInputs(tx, view, block.Index); err != nil {
+				return diff, fmt.Errorf("transaction %s: %w", tx.TxID, err)
+			}
+			for _, in := range tx.Inputs {
+				utxo, _ := view.GetUTXO(in.Outpoint())
+				view.spent[in.Outpoint()] = true
+				diff.spent = append(diff.spent, utxo)
+			}
+		}
+
+		for i, out := range tx.Outputs {
+			utxo := UTXO{
+				TxID:     tx.TxID,
+				Index:    i,
+				Amount:   out.Amount,
+				Address:  out.Address,
+				Height:   block.Index,
+				Coinbase: tx.IsCoinbase(),
+			}
+			if _, exists := view.GetUTXO(utxo.Outpoint()); exists {
+				return diff, fmt.Errorf("transaction %s duplicates an unspent output", tx.TxID)
+			}
+			view.created[utxo.Outpoint()] = utxo
+			diff.created = append(diff.created, utxo)
+		}
+	}
+
+	// Outputs created and spent inside the same block never reach the set
+	created := diff.created[:0]
+	for _, utxo := range diff.created {
+		if !view.spent[utxo.Outpoint()] {
+			created = append(created, utxo)
+		}
+	}
+	diff.created = created
+
+	spent := diff.spent[:0]
+	for _, utxo := range diff.spent {
+		if _, inBase := u.utxos[utxo.Outpoint()]; inBase {
+			spent = append(spent, utxo)
+		}
+	}
+	diff.spent = spent
+
+	return diff, nil
+}
+
+func sortUTXOs(utxos []UTXO) {
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].TxID != utxos[j].TxID {
+			return utxos[i].TxID < utxos[j].TxID
+		}
+		return utxos[i].Index < utxos[j].Index
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Block validation limits
+const (
+	MaxBlockSize       = 1 << 20 // Bytes of encoded block
+	maxFutureBlockTime = 2 * time.Hour
+	medianTimeBlocks   = 11 // Blocks the median time past is taken over
+)
+
+// Block validation errors. Every error returned by ValidateBlock wraps one
+// of these, or one of the coinbase errors in utxo.go.
+var (
+	ErrBadGenesis           = errors.New("genesis block does not match the network")
+	ErrBadBlockHash         = errors.New("block hash does not match its header")
+	ErrBadProofOfWork       = errors.New("block does not meet its proof-of-work target")
+	ErrBadPrevBlock         = errors.New("block does not extend its parent")
+	ErrBadDifficulty        = errors.New("block difficulty does not follow the retarget schedule")
+	ErrBadChainWork         = errors.New("block records the wrong chain work")
+	ErrTimeTooOld           = errors.New("block timestamp is before the median time past")
+	ErrTimeTooNew           = errors.New("block timestamp is too far in the future")
+	ErrBlockTooLarge        = errors.New("block exceeds the maximum size")
+	ErrBadMerkleRoot        = errors.New("block merkle root does not match its transactions")
+	ErrDuplicateTransaction = errors.New("block contains a duplicate transaction")
+	ErrInvalidTransaction   = errors.New("block contains an invalid transaction")
+)
+
+// ValidateBlock runs every check that does not need the UTXO set: the block
+// on its own (CheckBlockSanity) and against chain, the ancestry of the block
+// ending at its parent (CheckBlockContext). Spends are checked when the block
+// is connected to the UTXO set.
+func ValidateBlock(block Block, chain []Block) error {
+	// The genesis block is fixed by the network params
+	if block.Index == 0 {
+		if block.PrevHash != "" || block.Hash != activeParams.GenesisHash() ||
+			CalculateBlockHash(block) != block.Hash {
+			return fmt.Errorf("%w: hash %s on network %s", ErrBadGenesis, block.Hash, activeParams.Name)
+		}
+		return nil
+	}
+
+	if err := CheckBlockSanity(block); err != nil {
+		return err
+	}
+	return CheckBlockContext(block, chain)
+}
+
+// CheckBlockSanity checks a non-genesis block on its own: header hash, proof
+// of work, timestamp, size, merkle root, transactions and the coinbase reward
+func CheckBlockSanity(block Block) error {
+	if hash := CalculateBlockHash(block); hash != block.Hash {
+		return fmt.Errorf("%w: got %s, want %s", ErrBadBlockHash, block.Hash, hash)
+	}
+	if err := CheckHeaderSanity(block.BlockHeader); err != nil {
+		return err
+	}
+
+	if size := blockSize(block); size > MaxBlockSize {
+		return fmt.Errorf("%w: %d bytes", ErrBlockTooLarge, size)
+	}
+
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		return ErrMissingCoinbase
+	}
+	root, err := GetMerkleRoot(block.Transactions)
+	if err != nil || !bytes.Equal(root, block.MerkleRoot) {
+		return ErrBadMerkleRoot
+	}
+
+	seen := make(map[string]bool, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		if seen[tx.TxID] {
+			return fmt.Errorf("%w: %s", ErrDuplicateTransaction, tx.TxID)
+		}
+		seen[tx.TxID] = true
+
+		if i > 0 && tx.IsCoinbase() {
+			return fmt.Errorf("%w: coinbase %s must be the first transaction", ErrInvalidTransaction, tx.TxID)
+		}
+		if err := CheckTransaction(tx); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidTransaction, err)
+		}
+	}
+
+	coinbase := block.Transactions[0]
+	if coinbase.Inputs[0].Index != block.Index {
+		return fmt.Errorf("%w: coinbase %s claims height %d in block %d",
+			ErrInvalidTransaction, coinbase.TxID, coinbase.Inputs[0].Index, block.Index)
+	}
+	reward, err := CalculateBlockReward(block)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidTransaction, err)
+	}
+	paid, err := coinbase.TotalOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidTransaction, err)
+	}
+	if paid != reward {
+		return fmt.Errorf("%w: pays %s, expected %s", ErrBadCoinbaseReward, paid, reward)
+	}
+	return nil
+}
+
+// CheckBlockContext checks a non-genesis block against its ancestry: height,
+// parent hash, difficulty, chain work and median time past
+func CheckBlockContext(block Block, chain []Block) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("%w: block %d has no parent", ErrBadPrevBlock, block.Index)
+	}
+	prevBlock := chain[len(chain)-1]
+
+	if err := checkHeaderContext(block.BlockHeader, prevBlock.Hash, headerTail(chain)); err != nil {
+		return err
+	}
+	if expected := CalcChainWork(prevBlock, block.Bits); block.ChainWork != expected {
+		return fmt.Errorf("%w: got %s, want %s", ErrBadChainWork, block.ChainWork, expected)
+	}
+	return nil
+}
+
+// CheckHeaderSanity checks a non-genesis header on its own: proof of work
+// and timestamp
+func CheckHeaderSanity(header BlockHeader) error {
+	if err := CheckProofOfWork(header.BlockHash(), header.Bits); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadProofOfWork, err)
+	}
+	if limit := time.Now().Add(maxFutureBlockTime).Unix(); header.Timestamp > limit {
+		return fmt.Errorf("%w: %d", ErrTimeTooNew, header.Timestamp)
+	}
+	return nil
+}
+
+// CheckHeaderContext checks a non-genesis header against the headers before
+// it, ending at its parent: height, parent hash, difficulty and median time
+// past
+func CheckHeaderContext(header BlockHeader, headers []BlockHeader) error {
+	if len(headers) == 0 {
+		return fmt.Errorf("%w: header %d has no parent", ErrBadPrevBlock, header.Index)
+	}
+	return checkHeaderContext(header, headers[len(headers)-1].BlockHash(), headers)
+}
+
+// checkHeaderContext checks header against the headers before it, whose last
+// entry hashes to prevHash
+func checkHeaderContext(header BlockHeader, prevHash string, headers []BlockHeader) error {
+	prev := headers[len(headers)-1]
+	if header.Index != prev.Index+1 {
+		return fmt.Errorf("%w: invalid block index: got %d, want %d",
+			ErrBadPrevBlock, header.Index, prev.Index+1)
+	}
+	if header.PrevHash != prevHash {
+		return fmt.Errorf("%w: invalid previous hash", ErrBadPrevBlock)
+	}
+
+	if expected := CalcNextHeaderBits(headers); header.Bits != expected {
+		return fmt.Errorf("%w: got bits 0x%08x, want 0x%08x", ErrBadDifficulty, header.Bits, expected)
+	}
+	if median := medianTimePast(headers); header.Timestamp < median {
+		return fmt.Errorf("%w: %d < %d", ErrTimeTooOld, header.Timestamp, median)
+	}
+	return nil
+}
+
+// headerTail returns the headers of the last blocks of chain, as many as
+// the difficulty and median time past rules look at
+func headerTail(chain []Block) []BlockHeader {
+	n := medianTimeBlocks
+	if activeParams.RetargetInterval > n {
+		n = activeParams.RetargetInterval
+	}
+	if len(chain) > n {
+		chain = chain[len(chain)-n:]
+	}
+
+	headers := make([]BlockHeader, len(chain))
+	for i, block := range chain {
+		headers[i] = block.BlockHeader
+	}
+	return headers
+}
+
+// medianTimePast returns the median timestamp of the last headers
+func medianTimePast(headers []BlockHeader) int64 {
+	if len(headers) > medianTimeBlocks {
+		headers = headers[len(headers)-medianTimeBlocks:]
+	}
+
+	timestamps := make([]int64, len(headers))
+	for i, header := range headers {
+		timestamps[i] = header.Timestamp
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// blockSize returns the encoded size of a block
+func blockSize(block Block) int {
+	return len(EncodeBlock(block))
+}
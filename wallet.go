@@ -6,9 +6,14 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/btcsuite/btcutil/base58"
 	"golang.org/x/crypto/ripemd160"
@@ -19,7 +24,6 @@ type Wallet struct {
 	PrivateKey *ecdsa.PrivateKey
 	PublicKey  []byte
 	Address    string
-	UTXOs      []UTXO
 }
 
 // NewWallet creates and returns a new Wallet instance
@@ -37,10 +41,58 @@ func NewWallet() (*Wallet, error) {
 		PrivateKey: privateKey,
 		PublicKey:  publicKey,
 		Address:    address,
-		UTXOs:      make([]UTXO, 0),
 	}, nil
 }
 
+// walletKeyFile holds the node wallet's private key in the data directory,
+// DER encoded and readable by its owner only
+const walletKeyFile = "wallet.key"
+
+// LoadOrCreateWallet loads the wallet of dataDir, creating it on first run,
+// so mining rewards paid to it stay spendable across restarts
+func LoadOrCreateWallet(dataDir string) (*Wallet, error) {
+	path := filepath.Join(dataDir, walletKeyFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		privateKey, err := x509.ParseECPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wallet key %s: %w", path, err)
+		}
+		publicKey := generatePublicKey(privateKey)
+		return &Wallet{
+			PrivateKey: privateKey,
+			PublicKey:  publicKey,
+			Address:    generateAddress(publicKey),
+		}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read wallet key: %w", err)
+	}
+
+	wallet, err := NewWallet()
+	if err != nil {
+		return nil, err
+	}
+	if data, err = x509.MarshalECPrivateKey(wallet.PrivateKey); err != nil {
+		return nil, fmt.Errorf("failed to encode wallet key: %w", err)
+	}
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	// Write a temporary file first so a crash never leaves half a key
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write wallet key: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to write wallet key: %w", err)
+	}
+	fmt.Printf("🔑 Created wallet key %s\n", path)
+	return wallet, nil
+}
+
 // generatePrivateKey creates a new ECDSA private key
 func generatePrivateKey() (*ecdsa.PrivateKey, error) {
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -68,8 +120,8 @@ func generateAddress(publicKey []byte) string {
 	}
 	publicKeyHash := ripemd160Hasher.Sum(nil)
 
-	// Step 3: Add version byte in front (0x00 for mainnet)
-	versionedPayload := append([]byte{0x00}, publicKeyHash...)
+	// Step 3: Add the network's version byte in front
+	versionedPayload := append([]byte{activeParams.AddressVersion}, publicKeyHash...)
 
 	// Step 4: Double SHA-256 for checksum
 	firstHash := sha256.Sum256(versionedPayload)
@@ -96,8 +148,8 @@ func GenerateAddress(publicKey []byte) string {
 	}
 	publicKeyHash := ripemd160Hasher.Sum(nil)
 
-	// Step 3: Add version byte in front (0x00 for mainnet)
-	versionedPayload := append([]byte{0x00}, publicKeyHash...)
+	// Step 3: Add the network's version byte in front
+	versionedPayload := append([]byte{activeParams.AddressVersion}, publicKeyHash...)
 
 	// Step 4: Double SHA-256 for checksum
 	firstHash := sha256.Sum256(versionedPayload)
@@ -138,13 +190,7 @@ func (w *Wallet) SignTransaction(tx *Transaction) error {
 	tx.SenderPublicKey = w.GetPublicKeyBytes()
 
 	// Calculate transaction hash for signing
-	txData := fmt.Sprintf("%s%s%f%v",
-		tx.SenderAddress,
-		tx.Receiver,
-		tx.Amount,
-		tx.Timestamp.Unix())
-
-	txHash := sha256.Sum256([]byte(txData))
+	txHash := sha256.Sum256(txSigningData(*tx))
 
 	// Sign the transaction hash
 	signature, err := ecdsa.SignASN1(rand.Reader, w.PrivateKey, txHash[:])
@@ -159,6 +205,52 @@ func (w *Wallet) SignTransaction(tx *Transaction) error {
 	return nil
 }
 
+// CreateTransaction builds an unsigned transaction paying amount to receiver
+// from utxos, returning any change to the wallet's own address
+func (w *Wallet) CreateTransaction(utxos []UTXO, receiver string, amount, fee Amount) (Transaction, error) {
+	if amount <= 0 || !amount.IsValid() {
+		return Transaction{}, fmt.Errorf("amount must be positive and at most %s", MaxMoney)
+	}
+	if !fee.IsValid() {
+		return Transaction{}, fmt.Errorf("fee must not be negative")
+	}
+	if err := ValidateAddress(receiver); err != nil {
+		return Transaction{}, fmt.Errorf("invalid receiver: %w", err)
+	}
+
+	// Select coins until the amount and fee are covered
+	needed, err := amount.Add(fee)
+	if err != nil {
+		return Transaction{}, err
+	}
+	var selected Amount
+	inputs := make([]TxInput, 0)
+	for _, utxo := range utxos {
+		if selected >= needed {
+			break
+		}
+		inputs = append(inputs, TxInput{TxID: utxo.TxID, Index: utxo.Index})
+		if selected, err = selected.Add(utxo.Amount); err != nil {
+			return Transaction{}, err
+		}
+	}
+	if selected < needed {
+		return Transaction{}, fmt.Errorf("insufficient funds: have %s, need %s", selected, needed)
+	}
+
+	outputs := []TxOutput{{Address: receiver, Amount: amount}}
+	if change := selected - needed; change > 0 {
+		outputs = append(outputs, TxOutput{Address: w.Address, Amount: change})
+	}
+
+	return Transaction{
+		Inputs:    inputs,
+		Outputs:   outputs,
+		Timestamp: time.Now(),
+		Fee:       fee,
+	}, nil
+}
+
 // Verify transaction signature
 func VerifyTransactionSignature(tx *Transaction, signature string, pubKey ecdsa.PublicKey) bool {
 	txHash := sha256.Sum256([]byte(tx.TxID))
@@ -230,3 +322,61 @@ func VerifySignature(publicKeyBytes []byte, data []byte, signature []byte) bool
 // 		}
 // 	}
 // }
+
+// CreateTransactionAtRate is CreateTransaction with the fee that rate asks
+// for the signed transaction
+func (w *Wallet) CreateTransactionAtRate(utxos []UTXO, receiver string, amount Amount, rate FeeRate) (Transaction, error) {
+	var fee Amount
+	for {
+		tx, err := w.CreateTransaction(utxos, receiver, amount, fee)
+		if err != nil {
+			return Transaction{}, err
+		}
+
+		// Measure a signed copy; signatures vary by a couple of bytes
+		signed := tx
+		if err := w.SignTransaction(&signed); err != nil {
+			return Transaction{}, err
+		}
+		needed := rate.Fee(len(EncodeTransaction(signed)) + 2)
+		if fee >= needed {
+			return tx, nil
+		}
+		fee = needed // May select another input, so measure again
+	}
+}
+
+// BumpFee builds an unsigned replacement for a pending transaction of the
+// wallet that spends the same inputs and pays fee, taking the difference
+// from the change output
+func (w *Wallet) BumpFee(tx Transaction, fee Amount) (Transaction, error) {
+	if tx.SenderAddress != w.Address {
+		return Transaction{}, fmt.Errorf("transaction %s is not from this wallet", tx.TxID)
+	}
+	if fee <= tx.Fee || !fee.IsValid() {
+		return Transaction{}, fmt.Errorf("new fee %s must be higher than %s", fee, tx.Fee)
+	}
+
+	change := -1
+	for i, out := range tx.Outputs {
+		if out.Address == w.Address {
+			change = i
+		}
+	}
+	extra := fee - tx.Fee
+	if change < 0 || tx.Outputs[change].Amount < extra {
+		return Transaction{}, fmt.Errorf("insufficient change: need %s more for the fee", extra)
+	}
+
+	bumped := Transaction{
+		Inputs:    append([]TxInput(nil), tx.Inputs...),
+		Outputs:   append([]TxOutput(nil), tx.Outputs...),
+		Timestamp: time.Now(),
+		Fee:       fee,
+	}
+	bumped.Outputs[change].Amount -= extra
+	if bumped.Outputs[change].Amount == 0 {
+		bumped.Outputs = append(bumped.Outputs[:change], bumped.Outputs[change+1:]...)
+	}
+	return bumped, nil
+}